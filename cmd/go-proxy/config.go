@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/3box/go-proxy/common/config"
+)
+
+func validateConfigCommand(args []string) int {
+	if _, ok := loadConfig("validate-config", args); !ok {
+		return 1
+	}
+	fmt.Println("config is valid")
+	return 0
+}
+
+func printConfigCommand(args []string) int {
+	cfg, ok := loadConfig("print-config", args)
+	if !ok {
+		return 1
+	}
+	out, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode config: %v\n", err)
+		return 1
+	}
+	os.Stdout.Write(out)
+	return 0
+}
+
+// loadConfig loads the config the same way the server does, without logging it, and prints any errors one per line
+func loadConfig(command string, args []string) (*config.Config, bool) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	configFile := flags.String("config", "", "YAML, TOML or JSON config file, overrides GO_PROXY_CONFIG_FILE")
+	_ = flags.Parse(args)
+	config.SetConfigFile(*configFile)
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+		return nil, false
+	}
+	return cfg, true
+}
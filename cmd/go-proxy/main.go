@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
+	"os"
 	"runtime"
 
 	"github.com/3box/go-proxy/common/config"
@@ -11,7 +14,47 @@ import (
 	"github.com/3box/go-proxy/server"
 )
 
+const usage = `usage: go-proxy [command] [flags]
+
+commands:
+  serve            run the proxy (default)
+  replay           send recorded traffic to a target
+  validate-config  check the config and exit non-zero on errors
+  print-config     print the effective config with secrets redacted
+
+serve, validate-config and print-config read the config file given with -config
+`
+
 func main() {
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		serve(args)
+	case "replay":
+		os.Exit(replayCommand(args))
+	case "validate-config":
+		os.Exit(validateConfigCommand(args))
+	case "print-config":
+		os.Exit(printConfigCommand(args))
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+}
+
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFile := flags.String("config", "", "YAML, TOML or JSON config file, overrides GO_PROXY_CONFIG_FILE")
+	_ = flags.Parse(args)
+	config.SetConfigFile(*configFile)
+
 	serverCtx := context.Background()
 	ctr, err := container.BuildContainer(serverCtx)
 	if err != nil {
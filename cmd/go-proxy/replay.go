@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/3box/go-proxy/common/logging"
+	"github.com/3box/go-proxy/replay"
+)
+
+func replayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := flags.String("target", "", "URL the recorded requests are sent to (required)")
+	speed := flags.Float64("speed", 1, "multiplier for the recorded timing, 0 sends as fast as possible")
+	rate := flags.Float64("rate", 0, "maximum requests per second, replaces the recorded timing when set")
+	concurrency := flags.Int("concurrency", 10, "number of requests in flight")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout for each request")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: go-proxy replay -target <url> [flags] <recording>...")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if *target == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	logger := logging.NewLogger()
+	replayer, err := replay.NewReplayer(logger, replay.Options{
+		TargetURL:   *target,
+		Speed:       *speed,
+		Rate:        *rate,
+		Concurrency: *concurrency,
+		Timeout:     *timeout,
+	})
+	if err != nil {
+		logger.Errorf("replay: %v", err)
+		return 2
+	}
+
+	// Stop scheduling on interrupt but still print what was replayed so far
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	summary, err := replayer.Replay(ctx, flags.Args())
+	summary.Print(os.Stdout)
+	if err != nil {
+		logger.Errorf("replay: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -1,9 +1,14 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
 	"strings"
 	"time"
 
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/spf13/viper"
 
 	"github.com/3box/go-proxy/common/logging"
@@ -11,32 +16,411 @@ import (
 
 const ServiceName = "go-proxy"
 
+const configFileEnv = "GO_PROXY_CONFIG_FILE"
+
+// DefaultRouteName labels the requests proxied to Proxy.TargetURLs
+const DefaultRouteName = "default"
+
 const (
+	defaultRouteName         = "route"
 	defaultProxyListenPort   = "8080"
 	defaultMetricsListenPort = "9464"
 	defaultDialTimeout       = 30 * time.Second
 	defaultTimeout           = 120 * time.Second
+	defaultStreamIdleTimeout = 60 * time.Second
+	defaultMirrorName        = "mirror"
+	defaultMirrorUpgrades    = "skip"
+	defaultMirrorWorkers     = 16
+	defaultMirrorQueueSize   = 1024
+	defaultOverflowPolicy    = "drop_newest"
+	defaultBlockTimeout      = 100 * time.Millisecond
+	defaultMirrorMaxBodySize = 10 << 20
+	defaultRecordingFormat   = "jsonl"
+	defaultRecordingFileSize = 100 << 20
+	defaultRecordingQueue    = 1024
+	defaultHealthPath        = "/api/v0/node/healthcheck"
+	defaultHealthInterval    = 10 * time.Second
+	defaultHealthTimeout     = 5 * time.Second
+	defaultShutdownDelay     = 5 * time.Second
+	defaultBalancerStrategy  = "round_robin"
+	defaultUpstreamHostMode  = "target"
+	defaultTLSMinVersion     = "1.2"
+	defaultTLSReloadInterval = time.Minute
+
+	defaultRetryInitialBackoff = 25 * time.Millisecond
+	defaultRetryMaxBackoff     = time.Second
+	defaultRetryBudget         = 0.2
+	defaultRetryBudgetWindow   = 10 * time.Second
+	defaultRetryMinRetries     = 10
+
+	defaultActiveHealthInterval       = 10 * time.Second
+	defaultActiveHealthTimeout        = 5 * time.Second
+	defaultHealthyThreshold           = 2
+	defaultUnhealthyThreshold         = 3
+	defaultOutlierConsecutiveFailures = 5
+	defaultOutlierMinRequests         = 10
+	defaultOutlierWindow              = 10 * time.Second
+	defaultEjectionTime               = 30 * time.Second
+
+	defaultBreakerConsecutiveFailures = 5
+	defaultBreakerMinRequests         = 10
+	defaultBreakerWindow              = 10 * time.Second
+	defaultBreakerOpenTimeout         = 30 * time.Second
+	defaultBreakerHalfOpenRequests    = 1
 )
 
 type Config struct {
-	Proxy   ProxyConfig
-	Metrics MetricsConfig
+	Proxy     ProxyConfig
+	Recording RecordingConfig
+	Health    HealthConfig
+	Metrics   MetricsConfig
+	Admin     AdminConfig
+	// LogLevel overrides the LOG_LEVEL the process started with, e.g. "debug"
+	LogLevel string
 }
 
 type ProxyConfig struct {
-	TargetURL   string
+	// TargetURLs receive the requests that match none of the Routes, under the route name "default".
+	// TargetURL is shorthand for a single backend.
+	TargetURL    string
+	TargetURLs   []string
+	LoadBalancer LoadBalancerConfig
+	// Host decides the Host header sent to TargetURLs, routes without their own use it too
+	Host        UpstreamHostConfig
+	UpstreamTLS UpstreamTLSConfig
+	// Routes are matched in order and the first match handles the request
+	Routes []RouteConfig
+	// BackendHealth applies to the backends of every pool
+	BackendHealth BackendHealthConfig
+	Retry         RetryConfig
+	// MirrorURL is shorthand for a single mirror named "mirror"
 	MirrorURL   string
-	ListenPort  string
-	DialTimeout time.Duration
-	Timeout     time.Duration
+	Mirrors     []MirrorConfig
+	MirrorQueue MirrorQueueConfig
+	// MirrorMaxBodySize is the largest request or response body kept in memory for mirrors, comparisons, the
+	// recording and retries. Larger bodies are still proxied but not mirrored or retried.
+	MirrorMaxBodySize int64
+	ListenPort        string
+	TLS               ListenerTLSConfig
+	// AllowedMethods restricts the proxied methods when set, DeniedMethods are rejected even if allowed.
+	// Rejected requests get a 405. CONNECT opens a tunnel to a backend of the matched route, deny it unless that is
+	// wanted.
+	AllowedMethods []string
+	DeniedMethods  []string
+	// TrustedProxies are the CIDRs or addresses of the proxies in front of this one. Forwarding headers from them
+	// are appended to, those from any other client are replaced.
+	TrustedProxies []string
+	DialTimeout    time.Duration
+	// Timeout bounds a proxied request until its response is complete. Streaming responses (server-sent events or
+	// bodies of unknown length, e.g. chunked) are exempt once they start and are only cut after StreamIdleTimeout
+	// without data.
+	Timeout           time.Duration
+	StreamIdleTimeout time.Duration
+}
+
+// MirrorConfig describes a named target that receives a copy of every proxied request.
+// Lists of mirrors are best described in the config file, but can also be provided through the environment as JSON,
+// e.g. GO_PROXY_PROXY_MIRRORS='[{"Name":"canary","URL":"http://canary:7007","Timeout":"5s"}]'
+type MirrorConfig struct {
+	Name string
+	URL  string
+	// Timeout defaults to Proxy.Timeout
+	Timeout time.Duration
+	// Rules select the requests that are mirrored, a request is mirrored when any rule matches. No rules mirror
+	// every request.
+	Rules []RequestMatchConfig
+	// SampleRate is the fraction of requests mirrored, within [0, 1]. Unset mirrors every request, zero none.
+	SampleRate *float64
+	// SampleKey makes sampling deterministic by hashing a request key instead of rolling a die per request:
+	// "header:<name>", "trace_id" or "path:<segment index>" (e.g. "path:3" for /api/v0/streams/<id>)
+	SampleKey      string
+	Transform      TransformConfig
+	Compare        CompareConfig
+	CircuitBreaker CircuitBreakerConfig
+	// Upgrades decides what the mirror gets for upgraded connections such as WebSockets: "skip" (default) sends
+	// nothing, "handshake" sends the upgrade request and closes the connection once the mirror answers
+	Upgrades string
+}
+
+// RouteConfig sends the requests it matches to its own target
+type RouteConfig struct {
+	// Name labels the route's metrics, defaults to "route-<index>"
+	Name  string
+	Match RequestMatchConfig
+	// TargetURL is shorthand for a pool with a single backend in TargetURLs
+	TargetURL    string
+	TargetURLs   []string
+	LoadBalancer LoadBalancerConfig
+	// Host defaults to Proxy.Host, UpstreamTLS does not default to Proxy.UpstreamTLS
+	Host        UpstreamHostConfig
+	UpstreamTLS UpstreamTLSConfig
+	// Rewrite replaces a leading path prefix before the request is proxied, mirrors still get the original path
+	Rewrite PathPrefixConfig
+	// DialTimeout, Timeout and StreamIdleTimeout default to the Proxy ones
+	DialTimeout       time.Duration
+	Timeout           time.Duration
+	StreamIdleTimeout time.Duration
+	// Mirrors names the mirrors that may receive copies of the route's requests, all of them when empty.
+	// DisableMirrors mirrors none of them.
+	Mirrors        []string
+	DisableMirrors bool
+}
+
+// LoadBalancerConfig spreads requests across a pool of backends
+type LoadBalancerConfig struct {
+	// Strategy is "round_robin" (default), "least_connections", "random_two_choices" or "consistent_hash"
+	Strategy string
+	// HashKey is the request key hashed by "consistent_hash", in the same form as MirrorConfig.SampleKey.
+	// Requests without a key value are balanced round robin.
+	HashKey string
+}
+
+// UpstreamHostConfig decides the Host header of the requests sent to a target
+type UpstreamHostConfig struct {
+	// Mode is "target" (default) for the host of the target URL, "preserve" for the host the client asked for, or
+	// "override" for Value. Virtual-hosted backends usually need "preserve" or "override".
+	Mode  string
+	Value string
+}
+
+// UpstreamTLSConfig applies to the TLS connections to a target
+type UpstreamTLSConfig struct {
+	// ServerName is sent as SNI and checked against the backend certificate instead of the target URL's host
+	ServerName string
+}
+
+// RetryConfig resends proxied requests that failed with a transport error, or with one of RetryableStatuses.
+// Only idempotent methods are retried, and other methods when the request has an Idempotency-Key header.
+type RetryConfig struct {
+	// MaxAttempts includes the first attempt, retries are disabled below 2
+	MaxAttempts int
+	// Backoff before each retry is random up to InitialBackoff, doubling with every retry up to MaxBackoff
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	RetryableStatuses []int
+	// Budget caps retries to a fraction of the requests within BudgetWindow, so a struggling upstream does not get
+	// hit by a retry storm. MinRetries are allowed per window regardless, so retries still work under low traffic.
+	Budget       float64
+	BudgetWindow time.Duration
+	MinRetries   int
+}
+
+// BackendHealthConfig takes unhealthy backends out of their pools until they recover. When every backend of a pool
+// is unhealthy, requests are spread across all of them again.
+type BackendHealthConfig struct {
+	Active  ActiveHealthCheckConfig
+	Passive OutlierDetectionConfig
+}
+
+// ActiveHealthCheckConfig polls every backend
+type ActiveHealthCheckConfig struct {
+	Enabled bool
+	// Path defaults to Health.Path
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// ExpectedStatuses lists the healthy status codes, any 2xx when empty
+	ExpectedStatuses []int
+	// HealthyThreshold and UnhealthyThreshold are the consecutive checks needed to change a backend's health
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+// OutlierDetectionConfig ejects backends based on the proxied requests. Transport errors and 5xx responses count as
+// failures.
+type OutlierDetectionConfig struct {
+	Enabled bool
+	// ConsecutiveFailures ejects a backend after that many failures in a row, defaults to 5 unless ErrorRate is set
+	ConsecutiveFailures int
+	// ErrorRate ejects a backend once the failure ratio within Window reaches it, after at least MinRequests
+	ErrorRate   float64
+	MinRequests int
+	Window      time.Duration
+	// EjectionTime is how long an ejected backend stays out of rotation
+	EjectionTime time.Duration
+}
+
+// RequestMatchConfig matches requests on all of its non-empty conditions
+type RequestMatchConfig struct {
+	// Hosts are glob patterns for the request host without its port, e.g. "api.example.com" or "*.example.com"
+	Hosts []string
+	// Methods is an allowlist of HTTP methods
+	Methods []string
+	// PathPrefix must start the request path, e.g. "/api/v0/"
+	PathPrefix string
+	// Paths are glob patterns in path.Match syntax, e.g. "/api/v0/streams" or "/api/v0/streams/*"
+	Paths     []string
+	PathRegex string
+	// Headers must be present with the given value, an empty value only requires the header to be present
+	Headers map[string]string
+}
+
+// TransformConfig rewrites the mirrored copy of a request, leaving the proxied request untouched. Headers are
+// renamed first, then removed, then set.
+type TransformConfig struct {
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	// RenameHeaders maps the original header name to the new one
+	RenameHeaders map[string]string
+	PathPrefix    PathPrefixConfig
+	// Host replaces the Host header sent to the mirror
+	Host string
+	// SetQuery adds or replaces query parameters given as "name=value". It is a list rather than a map because
+	// config files lowercase map keys.
+	SetQuery    []string
+	RemoveQuery []string
+}
+
+// PathPrefixConfig replaces a leading path prefix, e.g. From "/api/v0" To "/staging/api/v0"
+type PathPrefixConfig struct {
+	From string
+	To   string
+}
+
+// CompareConfig enables diffing mirror responses against the primary response
+type CompareConfig struct {
+	Enabled bool
+	// Headers lists the response headers that must match
+	Headers []string
+	// IgnoredPaths lists dot-separated JSON body paths excluded from the diff, "*" matches any key or index
+	// (e.g. "metadata.updatedAt" or "items.*.timestamp")
+	IgnoredPaths []string
+}
+
+// CircuitBreakerConfig stops mirroring to an unhealthy mirror. Transport errors and 5xx responses count as failures.
+type CircuitBreakerConfig struct {
+	Enabled bool
+	// ConsecutiveFailures opens the circuit after that many failures in a row, defaults to 5 unless ErrorRate is set
+	ConsecutiveFailures int
+	// ErrorRate opens the circuit once the failure ratio within Window reaches it, after at least MinRequests
+	ErrorRate   float64
+	MinRequests int
+	Window      time.Duration
+	// OpenTimeout is how long the circuit stays open before HalfOpenRequests probes are let through
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+}
+
+// MirrorQueueConfig bounds the work queued for mirrors
+type MirrorQueueConfig struct {
+	Workers int
+	Size    int
+	// OverflowPolicy is applied when the queue is full: "drop_newest", "drop_oldest" or "block"
+	OverflowPolicy string
+	// BlockTimeout is how long the "block" policy waits for room before dropping the request
+	BlockTimeout time.Duration
+}
+
+// RecordingConfig captures proxied traffic to disk so it can be replayed later
+type RecordingConfig struct {
+	Enabled bool
+	// Directory receives files named traffic-<UTC time>-<sequence>.<format>[.gz]
+	Directory string
+	// Format is "jsonl" or "har"
+	Format   string
+	Compress bool
+	// MaxFileSize rotates the current file once that many uncompressed bytes were written to it
+	MaxFileSize int64
+	// RotateInterval rotates the current file after that long, zero only rotates on size
+	RotateInterval  time.Duration
+	IncludeResponse bool
+	// IncludeCredentials keeps the values of credential-like headers such as Authorization and Cookie, which are
+	// recorded as "REDACTED" otherwise. Replaying such a recording sends the placeholder.
+	IncludeCredentials bool
+	// QueueSize bounds the records waiting to be written, records are dropped when it is full
+	QueueSize int
+	// Rules, SampleRate and SampleKey select the recorded requests the same way as for mirrors
+	Rules      []RequestMatchConfig
+	SampleRate *float64
+	SampleKey  string
+}
+
+// HealthConfig drives readiness, which requires a backend of every pool (and optionally the mirrors) to answer Path
+// with a 2xx. Backends must also be in rotation, and with Proxy.BackendHealth.Active enabled readiness follows those
+// checks instead of probing the backends again.
+type HealthConfig struct {
+	Path           string
+	Interval       time.Duration
+	Timeout        time.Duration
+	IncludeMirrors bool
+	// ShutdownDelay keeps serving with failing readiness before shutting down, so load balancers drain us first
+	ShutdownDelay time.Duration
 }
 
 type MetricsConfig struct {
 	Enabled    bool
 	ListenPort string
+	// TLS applies to the metrics port, which also serves the admin endpoints
+	TLS ListenerTLSConfig
+}
+
+// ListenerTLSConfig terminates TLS on a listener, which serves plain HTTP without certificates
+type ListenerTLSConfig struct {
+	// CertFile and KeyFile are shorthand for a single entry in Certificates
+	CertFile string
+	KeyFile  string
+	// Certificates are picked by the server name the client asks for (SNI), the first one is served to clients that
+	// ask for none or for an unknown name
+	Certificates []CertificateConfig
+	// MinVersion is "1.0", "1.1", "1.2" (default) or "1.3"
+	MinVersion string
+	// CipherSuites restricts the TLS 1.0-1.2 cipher suites by name, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+	// Go's defaults apply when empty, TLS 1.3 suites are not configurable.
+	CipherSuites []string
+	// ReloadInterval is how often the certificate files are checked for changes, changed ones are loaded without
+	// a restart. Zero disables reloading.
+	ReloadInterval time.Duration
 }
 
+// CertificateConfig is a PEM certificate chain and its private key
+type CertificateConfig struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Enabled reports whether the listener serves TLS
+func (_this ListenerTLSConfig) Enabled() bool {
+	return len(_this.Certificates) > 0
+}
+
+// AdminConfig protects the admin endpoints that change the running proxy
+type AdminConfig struct {
+	// Token must be sent as a bearer token to reload the config, the endpoint is disabled without it
+	Token string
+}
+
+// configFile is set from the command line, see SetConfigFile
+var configFile string
+
+// SetConfigFile sets the config file read by LoadConfig, taking precedence over GO_PROXY_CONFIG_FILE
+func SetConfigFile(path string) {
+	configFile = path
+}
+
+// ConfigFile returns the config file read by LoadConfig, if any
+func ConfigFile() string {
+	if configFile != "" {
+		return configFile
+	}
+	return os.Getenv(configFileEnv)
+}
+
+// LoadConfig loads the config like Load and logs it with secrets redacted
 func LoadConfig(logger logging.Logger) (*Config, error) {
+	cfg, err := Load()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Infow("config loaded successfully",
+		"config", cfg.Redacted(),
+	)
+
+	return cfg, nil
+}
+
+// Load reads the config file, if any, then applies GO_PROXY_* environment overrides and validates the result
+func Load() (*Config, error) {
 	// Create a new viper instance with the experimental bind struct feature enabled
 	v := viper.NewWithOptions(
 		viper.ExperimentalBindStruct(),
@@ -46,20 +430,230 @@ func LoadConfig(logger logging.Logger) (*Config, error) {
 	v.SetEnvPrefix("GO_PROXY")
 	v.AutomaticEnv()
 
+	// The format (YAML, TOML or JSON) follows the file extension, environment variables take precedence
+	if path := ConfigFile(); path != "" {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+		}
+	}
+
 	v.SetDefault("Proxy.ListenPort", defaultProxyListenPort)
 	v.SetDefault("Proxy.DialTimeout", defaultDialTimeout)
 	v.SetDefault("Proxy.Timeout", defaultTimeout)
+	v.SetDefault("Proxy.StreamIdleTimeout", defaultStreamIdleTimeout)
+	v.SetDefault("Proxy.MirrorQueue.Workers", defaultMirrorWorkers)
+	v.SetDefault("Proxy.MirrorQueue.Size", defaultMirrorQueueSize)
+	v.SetDefault("Proxy.MirrorQueue.OverflowPolicy", defaultOverflowPolicy)
+	v.SetDefault("Proxy.MirrorQueue.BlockTimeout", defaultBlockTimeout)
+	v.SetDefault("Proxy.MirrorMaxBodySize", defaultMirrorMaxBodySize)
+	v.SetDefault("Proxy.LoadBalancer.Strategy", defaultBalancerStrategy)
+	v.SetDefault("Proxy.Host.Mode", defaultUpstreamHostMode)
+	v.SetDefault("Proxy.Retry.InitialBackoff", defaultRetryInitialBackoff)
+	v.SetDefault("Proxy.Retry.MaxBackoff", defaultRetryMaxBackoff)
+	v.SetDefault("Proxy.Retry.Budget", defaultRetryBudget)
+	v.SetDefault("Proxy.Retry.BudgetWindow", defaultRetryBudgetWindow)
+	v.SetDefault("Proxy.Retry.MinRetries", defaultRetryMinRetries)
+	v.SetDefault("Proxy.BackendHealth.Active.Interval", defaultActiveHealthInterval)
+	v.SetDefault("Proxy.BackendHealth.Active.Timeout", defaultActiveHealthTimeout)
+	v.SetDefault("Proxy.BackendHealth.Active.HealthyThreshold", defaultHealthyThreshold)
+	v.SetDefault("Proxy.BackendHealth.Active.UnhealthyThreshold", defaultUnhealthyThreshold)
+	v.SetDefault("Proxy.BackendHealth.Passive.MinRequests", defaultOutlierMinRequests)
+	v.SetDefault("Proxy.BackendHealth.Passive.Window", defaultOutlierWindow)
+	v.SetDefault("Proxy.BackendHealth.Passive.EjectionTime", defaultEjectionTime)
+	v.SetDefault("Proxy.TLS.MinVersion", defaultTLSMinVersion)
+	v.SetDefault("Proxy.TLS.ReloadInterval", defaultTLSReloadInterval)
+	v.SetDefault("Metrics.TLS.MinVersion", defaultTLSMinVersion)
+	v.SetDefault("Metrics.TLS.ReloadInterval", defaultTLSReloadInterval)
+	v.SetDefault("Recording.Format", defaultRecordingFormat)
+	v.SetDefault("Recording.MaxFileSize", defaultRecordingFileSize)
+	v.SetDefault("Recording.QueueSize", defaultRecordingQueue)
+	v.SetDefault("Health.Path", defaultHealthPath)
+	v.SetDefault("Health.Interval", defaultHealthInterval)
+	v.SetDefault("Health.Timeout", defaultHealthTimeout)
+	v.SetDefault("Health.ShutdownDelay", defaultShutdownDelay)
 	v.SetDefault("Metrics.ListenPort", defaultMetricsListenPort)
 
 	// Unmarshal environment variables into the config struct
 	var cfg Config
-	if err := v.Unmarshal(&cfg); err != nil {
+	if err := v.Unmarshal(&cfg, viper.DecodeHook(decodeHook())); err != nil {
 		return nil, err
 	}
 
-	logger.Infow("config loaded successfully",
-		"config", cfg,
-	)
+	applyMirrorDefaults(&cfg.Proxy)
+	applyRouteDefaults(&cfg.Proxy)
+	applyBackendHealthDefaults(&cfg.Proxy.BackendHealth, cfg.Health.Path)
+	applyRecordingDefaults(&cfg.Recording)
+	applyTLSDefaults(&cfg.Proxy.TLS)
+	applyTLSDefaults(&cfg.Metrics.TLS)
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
 	return &cfg, nil
 }
+
+// decodeHook extends viper's default hooks so that lists of structs (e.g. mirrors) can be passed as JSON strings, and
+// other lists as comma-separated strings (e.g. GO_PROXY_PROXY_RETRY_RETRYABLESTATUSES=502,503)
+func decodeHook() mapstructure.DecodeHookFunc {
+	return mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		jsonStringHookFunc(),
+		commaSeparatedHookFunc(),
+	)
+}
+
+func jsonStringHookFunc() mapstructure.DecodeHookFunc {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String {
+			return data, nil
+		}
+		// Only slices of structs and maps are decoded from JSON, plain string slices are still comma-separated
+		isStructSlice := t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct
+		if !isStructSlice && t.Kind() != reflect.Map {
+			return data, nil
+		}
+
+		raw := strings.TrimSpace(data.(string))
+		if raw == "" {
+			return nil, nil
+		}
+
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(raw), &decoded); err != nil {
+			return nil, fmt.Errorf("invalid JSON value for %s: %w", t, err)
+		}
+		return decoded, nil
+	}
+}
+
+// commaSeparatedHookFunc splits a string into a list of any element type, where mapstructure's own hook only produces
+// string lists
+func commaSeparatedHookFunc() mapstructure.DecodeHookFunc {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String || t.Kind() != reflect.Slice {
+			return data, nil
+		}
+
+		raw := strings.TrimSpace(data.(string))
+		if raw == "" {
+			return reflect.MakeSlice(t, 0, 0).Interface(), nil
+		}
+		items := strings.Split(raw, ",")
+		for i := range items {
+			items[i] = strings.TrimSpace(items[i])
+		}
+		if t.Elem().Kind() == reflect.String {
+			return items, nil
+		}
+
+		decoded := reflect.New(t)
+		if err := mapstructure.WeakDecode(items, decoded.Interface()); err != nil {
+			return nil, fmt.Errorf("invalid list value for %s: %w", t, err)
+		}
+		return decoded.Elem().Interface(), nil
+	}
+}
+
+func applyTLSDefaults(cfg *ListenerTLSConfig) {
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cfg.Certificates = append([]CertificateConfig{{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile}}, cfg.Certificates...)
+		cfg.CertFile, cfg.KeyFile = "", ""
+	}
+}
+
+func applyMirrorDefaults(cfg *ProxyConfig) {
+	// Shorthands are folded into the lists so the effective config reads back the same
+	if cfg.MirrorURL != "" {
+		cfg.Mirrors = append([]MirrorConfig{{Name: defaultMirrorName, URL: cfg.MirrorURL}}, cfg.Mirrors...)
+		cfg.MirrorURL = ""
+	}
+	for i := range cfg.Mirrors {
+		if cfg.Mirrors[i].Name == "" {
+			cfg.Mirrors[i].Name = fmt.Sprintf("%s-%d", defaultMirrorName, i)
+		}
+		if cfg.Mirrors[i].Timeout == 0 {
+			cfg.Mirrors[i].Timeout = cfg.Timeout
+		}
+		if cfg.Mirrors[i].Upgrades == "" {
+			cfg.Mirrors[i].Upgrades = defaultMirrorUpgrades
+		}
+		if cfg.Mirrors[i].SampleRate == nil {
+			cfg.Mirrors[i].SampleRate = sampleAll()
+		}
+		applyCircuitBreakerDefaults(&cfg.Mirrors[i].CircuitBreaker)
+	}
+}
+
+func applyCircuitBreakerDefaults(cfg *CircuitBreakerConfig) {
+	// An error rate alone decides when to open the circuit
+	if cfg.ConsecutiveFailures == 0 && cfg.ErrorRate == 0 {
+		cfg.ConsecutiveFailures = defaultBreakerConsecutiveFailures
+	}
+	if cfg.MinRequests == 0 {
+		cfg.MinRequests = defaultBreakerMinRequests
+	}
+	if cfg.Window == 0 {
+		cfg.Window = defaultBreakerWindow
+	}
+	if cfg.OpenTimeout == 0 {
+		cfg.OpenTimeout = defaultBreakerOpenTimeout
+	}
+	if cfg.HalfOpenRequests == 0 {
+		cfg.HalfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+}
+
+func applyBackendHealthDefaults(cfg *BackendHealthConfig, healthPath string) {
+	if cfg.Active.Path == "" {
+		cfg.Active.Path = healthPath
+	}
+	// An error rate alone decides when to eject a backend
+	if cfg.Passive.ConsecutiveFailures == 0 && cfg.Passive.ErrorRate == 0 {
+		cfg.Passive.ConsecutiveFailures = defaultOutlierConsecutiveFailures
+	}
+}
+
+func applyRecordingDefaults(cfg *RecordingConfig) {
+	if cfg.SampleRate == nil {
+		cfg.SampleRate = sampleAll()
+	}
+}
+
+// sampleAll is the sample rate of an unset SampleRate, which must stay distinguishable from an explicit zero
+func sampleAll() *float64 {
+	rate := 1.0
+	return &rate
+}
+
+func applyRouteDefaults(cfg *ProxyConfig) {
+	if cfg.TargetURL != "" {
+		cfg.TargetURLs = append([]string{cfg.TargetURL}, cfg.TargetURLs...)
+		cfg.TargetURL = ""
+	}
+	for i := range cfg.Routes {
+		if cfg.Routes[i].TargetURL != "" {
+			cfg.Routes[i].TargetURLs = append([]string{cfg.Routes[i].TargetURL}, cfg.Routes[i].TargetURLs...)
+			cfg.Routes[i].TargetURL = ""
+		}
+		if cfg.Routes[i].LoadBalancer.Strategy == "" {
+			cfg.Routes[i].LoadBalancer.Strategy = defaultBalancerStrategy
+		}
+		if cfg.Routes[i].Name == "" {
+			cfg.Routes[i].Name = fmt.Sprintf("%s-%d", defaultRouteName, i)
+		}
+		if cfg.Routes[i].DialTimeout == 0 {
+			cfg.Routes[i].DialTimeout = cfg.DialTimeout
+		}
+		if cfg.Routes[i].Timeout == 0 {
+			cfg.Routes[i].Timeout = cfg.Timeout
+		}
+		if cfg.Routes[i].StreamIdleTimeout == 0 {
+			cfg.Routes[i].StreamIdleTimeout = cfg.StreamIdleTimeout
+		}
+		if cfg.Routes[i].Host.Mode == "" {
+			cfg.Routes[i].Host = cfg.Host
+		}
+	}
+}
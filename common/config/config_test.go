@@ -0,0 +1,69 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLoadCommaSeparatedLists(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		got     func(cfg *Config) interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name: "string list",
+			env:  map[string]string{"GO_PROXY_PROXY_ALLOWEDMETHODS": "GET,HEAD"},
+			got:  func(cfg *Config) interface{} { return cfg.Proxy.AllowedMethods },
+			want: []string{"GET", "HEAD"},
+		},
+		{
+			name: "int list",
+			env:  map[string]string{"GO_PROXY_PROXY_RETRY_RETRYABLESTATUSES": "502,503"},
+			got:  func(cfg *Config) interface{} { return cfg.Proxy.Retry.RetryableStatuses },
+			want: []int{502, 503},
+		},
+		{
+			name: "spaces around items",
+			env:  map[string]string{"GO_PROXY_PROXY_BACKENDHEALTH_ACTIVE_EXPECTEDSTATUSES": " 200, 204 "},
+			got:  func(cfg *Config) interface{} { return cfg.Proxy.BackendHealth.Active.ExpectedStatuses },
+			want: []int{200, 204},
+		},
+		{
+			name: "single item",
+			env:  map[string]string{"GO_PROXY_PROXY_RETRY_RETRYABLESTATUSES": "503"},
+			got:  func(cfg *Config) interface{} { return cfg.Proxy.Retry.RetryableStatuses },
+			want: []int{503},
+		},
+		{
+			name:    "item of the wrong type",
+			env:     map[string]string{"GO_PROXY_PROXY_RETRY_RETRYABLESTATUSES": "502,bad"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(configFileEnv, "")
+			t.Setenv("GO_PROXY_PROXY_TARGETURL", "http://localhost:8081")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := Load()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := tt.got(cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
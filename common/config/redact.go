@@ -0,0 +1,134 @@
+package config
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// sensitiveHeaderParts flags header names whose values are secrets
+var sensitiveHeaderParts = []string{"auth", "cookie", "token", "secret", "key", "password"}
+
+// Redacted returns a copy of the config that is safe to log or print: the admin token, passwords in URLs and the
+// values of credential-like headers and query parameters are replaced
+func (_this *Config) Redacted() Config {
+	cfg := *_this
+	cfg.Admin.Token = redactString(cfg.Admin.Token)
+	cfg.Proxy.TargetURL = redactURL(cfg.Proxy.TargetURL)
+	cfg.Proxy.TargetURLs = redactURLs(cfg.Proxy.TargetURLs)
+	cfg.Proxy.MirrorURL = redactURL(cfg.Proxy.MirrorURL)
+
+	cfg.Proxy.Mirrors = make([]MirrorConfig, len(_this.Proxy.Mirrors))
+	for i, mirror := range _this.Proxy.Mirrors {
+		mirror.URL = redactURL(mirror.URL)
+		mirror.Rules = redactRules(mirror.Rules)
+		mirror.Transform.SetHeaders = redactHeaders(mirror.Transform.SetHeaders)
+		mirror.Transform.SetQuery = redactQuery(mirror.Transform.SetQuery)
+		cfg.Proxy.Mirrors[i] = mirror
+	}
+	cfg.Proxy.Routes = make([]RouteConfig, len(_this.Proxy.Routes))
+	for i, route := range _this.Proxy.Routes {
+		route.TargetURL = redactURL(route.TargetURL)
+		route.TargetURLs = redactURLs(route.TargetURLs)
+		route.Match.Headers = redactHeaders(route.Match.Headers)
+		cfg.Proxy.Routes[i] = route
+	}
+	cfg.Recording.Rules = redactRules(cfg.Recording.Rules)
+	return cfg
+}
+
+func redactString(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redacted
+}
+
+func redactURL(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.User == nil {
+		return value
+	}
+	return parsed.Redacted()
+}
+
+func redactURLs(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	redactedURLs := make([]string, len(values))
+	for i, value := range values {
+		redactedURLs[i] = redactURL(value)
+	}
+	return redactedURLs
+}
+
+func redactRules(rules []RequestMatchConfig) []RequestMatchConfig {
+	if rules == nil {
+		return nil
+	}
+	redactedRules := make([]RequestMatchConfig, len(rules))
+	for i, rule := range rules {
+		rule.Headers = redactHeaders(rule.Headers)
+		redactedRules[i] = rule
+	}
+	return redactedRules
+}
+
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	redactedHeaders := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if SensitiveHeader(name) {
+			value = redactString(value)
+		}
+		redactedHeaders[name] = value
+	}
+	return redactedHeaders
+}
+
+// redactQuery replaces the values of "name=value" pairs whose names look like credentials, e.g. api_key
+func redactQuery(pairs []string) []string {
+	if pairs == nil {
+		return nil
+	}
+	redactedPairs := make([]string, len(pairs))
+	for i, pair := range pairs {
+		if name, value, found := strings.Cut(pair, "="); found && SensitiveHeader(name) {
+			pair = name + "=" + redactString(value)
+		}
+		redactedPairs[i] = pair
+	}
+	return redactedPairs
+}
+
+// RedactHeader returns a copy of the header with the values of credential-like headers replaced
+func RedactHeader(header http.Header) http.Header {
+	if header == nil {
+		return nil
+	}
+	redactedHeader := make(http.Header, len(header))
+	for name, values := range header {
+		if SensitiveHeader(name) {
+			values = []string{redacted}
+		}
+		redactedHeader[name] = values
+	}
+	return redactedHeader
+}
+
+// SensitiveHeader reports whether the values of a header are likely secrets, e.g. Authorization or Cookie. Query
+// parameter names are checked the same way.
+func SensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range sensitiveHeaderParts {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
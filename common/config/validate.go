@@ -0,0 +1,381 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	overflowPolicies   = []string{"drop_newest", "drop_oldest", "block"}
+	recordingFormats   = []string{"jsonl", "har"}
+	mirrorUpgrades     = []string{"skip", "handshake"}
+	balancerStrategies = []string{"round_robin", "least_connections", "random_two_choices", "consistent_hash"}
+	upstreamHostModes  = []string{"target", "preserve", "override"}
+	tlsVersions        = []string{"1.0", "1.1", "1.2", "1.3"}
+	httpMethods        = []string{
+		http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+	}
+)
+
+// validator collects every problem found in a config instead of stopping at the first one
+type validator struct {
+	errs []error
+}
+
+func (_this *validator) addf(format string, args ...interface{}) {
+	_this.errs = append(_this.errs, fmt.Errorf(format, args...))
+}
+
+// Validate checks the whole config and reports all problems at once
+func (_this *Config) Validate() error {
+	v := &validator{}
+
+	// Without a default target every request must be routed
+	if len(_this.Proxy.TargetURLs) > 0 || len(_this.Proxy.Routes) == 0 {
+		v.targets("Proxy", _this.Proxy.TargetURLs, _this.Proxy.LoadBalancer)
+	}
+	v.upstreamHost("Proxy.Host", _this.Proxy.Host)
+	proxyPort := v.port("Proxy.ListenPort", _this.Proxy.ListenPort)
+	metricsPort := v.port("Metrics.ListenPort", _this.Metrics.ListenPort)
+	if proxyPort != 0 && proxyPort == metricsPort {
+		v.addf("Proxy.ListenPort and Metrics.ListenPort both use port %d", proxyPort)
+	}
+	v.listenerTLS("Proxy.TLS", _this.Proxy.TLS)
+	v.listenerTLS("Metrics.TLS", _this.Metrics.TLS)
+	// Methods are matched regardless of case, a typo would otherwise reject every request without saying why
+	for i, method := range _this.Proxy.AllowedMethods {
+		v.oneOf(fmt.Sprintf("Proxy.AllowedMethods[%d]", i), strings.ToUpper(method), httpMethods)
+	}
+	for i, method := range _this.Proxy.DeniedMethods {
+		v.oneOf(fmt.Sprintf("Proxy.DeniedMethods[%d]", i), strings.ToUpper(method), httpMethods)
+	}
+	for i, trusted := range _this.Proxy.TrustedProxies {
+		v.addressRange(fmt.Sprintf("Proxy.TrustedProxies[%d]", i), trusted)
+	}
+	v.nonNegative("Proxy.DialTimeout", _this.Proxy.DialTimeout)
+	v.nonNegative("Proxy.Timeout", _this.Proxy.Timeout)
+	v.nonNegative("Proxy.StreamIdleTimeout", _this.Proxy.StreamIdleTimeout)
+	if _this.Proxy.MirrorMaxBodySize < 0 {
+		v.addf("Proxy.MirrorMaxBodySize must not be negative")
+	}
+
+	names := make(map[string]bool)
+	for i, mirror := range _this.Proxy.Mirrors {
+		field := fmt.Sprintf("Proxy.Mirrors[%d]", i)
+		if names[mirror.Name] {
+			v.addf("%s: duplicate mirror name %q", field, mirror.Name)
+		}
+		names[mirror.Name] = true
+		v.url(field+".URL", mirror.URL)
+		v.nonNegative(field+".Timeout", mirror.Timeout)
+		v.rules(field+".Rules", mirror.Rules)
+		v.sampling(field, mirror.SampleRate, mirror.SampleKey)
+		v.transform(field+".Transform", mirror.Transform)
+		v.circuitBreaker(field+".CircuitBreaker", mirror.CircuitBreaker)
+		v.oneOf(field+".Upgrades", mirror.Upgrades, mirrorUpgrades)
+	}
+
+	routeNames := make(map[string]bool)
+	for i, route := range _this.Proxy.Routes {
+		field := fmt.Sprintf("Proxy.Routes[%d]", i)
+		if routeNames[route.Name] || route.Name == DefaultRouteName {
+			v.addf("%s: duplicate route name %q", field, route.Name)
+		}
+		routeNames[route.Name] = true
+		v.targets(field, route.TargetURLs, route.LoadBalancer)
+		v.rule(field+".Match", route.Match)
+		v.pathPrefix(field+".Rewrite", route.Rewrite)
+		v.upstreamHost(field+".Host", route.Host)
+		v.nonNegative(field+".DialTimeout", route.DialTimeout)
+		v.nonNegative(field+".Timeout", route.Timeout)
+		v.nonNegative(field+".StreamIdleTimeout", route.StreamIdleTimeout)
+		for _, name := range route.Mirrors {
+			if !names[name] {
+				v.addf("%s.Mirrors: unknown mirror %q", field, name)
+			}
+		}
+	}
+
+	v.backendHealth("Proxy.BackendHealth", _this.Proxy.BackendHealth)
+	v.retry("Proxy.Retry", _this.Proxy.Retry)
+
+	queue := _this.Proxy.MirrorQueue
+	if queue.Workers <= 0 {
+		v.addf("Proxy.MirrorQueue.Workers must be positive")
+	}
+	if queue.Size <= 0 {
+		v.addf("Proxy.MirrorQueue.Size must be positive")
+	}
+	v.oneOf("Proxy.MirrorQueue.OverflowPolicy", queue.OverflowPolicy, overflowPolicies)
+	v.nonNegative("Proxy.MirrorQueue.BlockTimeout", queue.BlockTimeout)
+
+	if _this.Recording.Enabled {
+		if _this.Recording.Directory == "" {
+			v.addf("Recording.Directory is required when recording is enabled")
+		}
+		v.oneOf("Recording.Format", _this.Recording.Format, recordingFormats)
+		if _this.Recording.QueueSize <= 0 {
+			v.addf("Recording.QueueSize must be positive")
+		}
+		v.nonNegative("Recording.RotateInterval", _this.Recording.RotateInterval)
+		v.rules("Recording.Rules", _this.Recording.Rules)
+		v.sampling("Recording", _this.Recording.SampleRate, _this.Recording.SampleKey)
+	}
+
+	if _this.Health.Interval <= 0 {
+		v.addf("Health.Interval must be positive")
+	}
+	v.nonNegative("Health.Timeout", _this.Health.Timeout)
+	v.nonNegative("Health.ShutdownDelay", _this.Health.ShutdownDelay)
+	if _this.LogLevel != "" {
+		if _, err := zapcore.ParseLevel(_this.LogLevel); err != nil {
+			v.addf("LogLevel: %v", err)
+		}
+	}
+
+	return errors.Join(v.errs...)
+}
+
+func (_this *validator) url(field, value string) {
+	if value == "" {
+		_this.addf("%s is required", field)
+		return
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		_this.addf("%s: %v", field, err)
+		return
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		_this.addf("%s: %q must be an absolute http(s) URL", field, value)
+	}
+}
+
+func (_this *validator) targets(field string, targets []string, balancer LoadBalancerConfig) {
+	if len(targets) == 0 {
+		_this.addf("%s.TargetURL or %s.TargetURLs is required", field, field)
+	}
+	seen := make(map[string]bool, len(targets))
+	for i, target := range targets {
+		_this.url(fmt.Sprintf("%s.TargetURLs[%d]", field, i), target)
+		if seen[target] {
+			_this.addf("%s.TargetURLs: duplicate backend %q", field, target)
+		}
+		seen[target] = true
+	}
+	_this.oneOf(field+".LoadBalancer.Strategy", balancer.Strategy, balancerStrategies)
+	if balancer.Strategy == "consistent_hash" && balancer.HashKey == "" {
+		_this.addf("%s.LoadBalancer.HashKey is required by consistent_hash", field)
+	}
+	_this.requestKey(field+".LoadBalancer.HashKey", balancer.HashKey)
+}
+
+func (_this *validator) upstreamHost(field string, host UpstreamHostConfig) {
+	_this.oneOf(field+".Mode", host.Mode, upstreamHostModes)
+	if host.Mode == "override" && host.Value == "" {
+		_this.addf("%s.Value is required by override", field)
+	}
+	if host.Mode != "override" && host.Value != "" {
+		_this.addf("%s.Value is only used by override", field)
+	}
+}
+
+func (_this *validator) listenerTLS(field string, cfg ListenerTLSConfig) {
+	for i, cert := range cfg.Certificates {
+		if cert.CertFile == "" || cert.KeyFile == "" {
+			_this.addf("%s.Certificates[%d] needs both CertFile and KeyFile", field, i)
+		}
+	}
+	_this.oneOf(field+".MinVersion", cfg.MinVersion, tlsVersions)
+	suites := make(map[string]bool)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = true
+	}
+	for i, name := range cfg.CipherSuites {
+		if !suites[name] {
+			_this.addf("%s.CipherSuites[%d]: %q is not a supported cipher suite", field, i, name)
+		}
+	}
+	_this.nonNegative(field+".ReloadInterval", cfg.ReloadInterval)
+}
+
+func (_this *validator) port(field, value string) int {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		_this.addf("%s: %q is not a valid port", field, value)
+		return 0
+	}
+	return port
+}
+
+// addressRange accepts a CIDR or a single IP address
+func (_this *validator) addressRange(field, value string) {
+	if _, err := netip.ParsePrefix(value); err == nil {
+		return
+	}
+	if _, err := netip.ParseAddr(value); err != nil {
+		_this.addf("%s: %q is neither a CIDR nor an IP address", field, value)
+	}
+}
+
+func (_this *validator) nonNegative(field string, value time.Duration) {
+	if value < 0 {
+		_this.addf("%s must not be negative", field)
+	}
+}
+
+func (_this *validator) positive(field string, value time.Duration) {
+	if value <= 0 {
+		_this.addf("%s must be positive", field)
+	}
+}
+
+func (_this *validator) oneOf(field, value string, allowed []string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	_this.addf("%s: %q must be one of %s", field, value, strings.Join(allowed, ", "))
+}
+
+func (_this *validator) rules(field string, rules []RequestMatchConfig) {
+	for i, rule := range rules {
+		_this.rule(fmt.Sprintf("%s[%d]", field, i), rule)
+	}
+}
+
+func (_this *validator) rule(field string, rule RequestMatchConfig) {
+	for _, pattern := range rule.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			_this.addf("%s.Hosts: invalid pattern %q", field, pattern)
+		}
+	}
+	for _, pattern := range rule.Paths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			_this.addf("%s.Paths: invalid pattern %q", field, pattern)
+		}
+	}
+	if rule.PathRegex != "" {
+		if _, err := regexp.Compile(rule.PathRegex); err != nil {
+			_this.addf("%s.PathRegex: %v", field, err)
+		}
+	}
+}
+
+func (_this *validator) sampling(field string, rate *float64, key string) {
+	if rate != nil && (*rate < 0 || *rate > 1) {
+		_this.addf("%s.SampleRate: %v is not within [0, 1]", field, *rate)
+	}
+	_this.requestKey(field+".SampleKey", key)
+}
+
+// requestKey checks keys of the form "header:<name>", "trace_id" or "path:<segment index>"
+func (_this *validator) requestKey(field, key string) {
+	if key == "" {
+		return
+	}
+	kind, arg, _ := strings.Cut(key, ":")
+	switch kind {
+	case "trace_id":
+		return
+	case "header":
+		if arg != "" {
+			return
+		}
+	case "path":
+		if index, err := strconv.Atoi(arg); err == nil && index >= 0 {
+			return
+		}
+	}
+	_this.addf("%s: invalid key %q", field, key)
+}
+
+func (_this *validator) pathPrefix(field string, prefix PathPrefixConfig) {
+	if prefix.From == "" && prefix.To != "" {
+		_this.addf("%s: From is required with To", field)
+	}
+}
+
+func (_this *validator) transform(field string, transform TransformConfig) {
+	_this.pathPrefix(field+".PathPrefix", transform.PathPrefix)
+	for _, pair := range transform.SetQuery {
+		if name, _, found := strings.Cut(pair, "="); !found || name == "" {
+			_this.addf("%s.SetQuery: %q is not of the form name=value", field, pair)
+		}
+	}
+}
+
+func (_this *validator) circuitBreaker(field string, breaker CircuitBreakerConfig) {
+	if !breaker.Enabled {
+		return
+	}
+	if breaker.ErrorRate < 0 || breaker.ErrorRate > 1 {
+		_this.addf("%s.ErrorRate: %v is not within [0, 1]", field, breaker.ErrorRate)
+	}
+	if breaker.ConsecutiveFailures < 0 || breaker.MinRequests < 0 {
+		_this.addf("%s: counts must not be negative", field)
+	}
+	if breaker.HalfOpenRequests < 1 {
+		_this.addf("%s.HalfOpenRequests must be at least 1", field)
+	}
+	_this.nonNegative(field+".Window", breaker.Window)
+	_this.nonNegative(field+".OpenTimeout", breaker.OpenTimeout)
+}
+
+func (_this *validator) backendHealth(field string, health BackendHealthConfig) {
+	active := health.Active
+	if active.Enabled {
+		_this.positive(field+".Active.Interval", active.Interval)
+		_this.nonNegative(field+".Active.Timeout", active.Timeout)
+		for _, status := range active.ExpectedStatuses {
+			if status < 100 || status > 599 {
+				_this.addf("%s.Active.ExpectedStatuses: %d is not an HTTP status", field, status)
+			}
+		}
+		if active.HealthyThreshold < 0 || active.UnhealthyThreshold < 0 {
+			_this.addf("%s.Active: thresholds must not be negative", field)
+		}
+	}
+
+	passive := health.Passive
+	if passive.Enabled {
+		if passive.ErrorRate < 0 || passive.ErrorRate > 1 {
+			_this.addf("%s.Passive.ErrorRate: %v is not within [0, 1]", field, passive.ErrorRate)
+		}
+		if passive.ConsecutiveFailures < 0 || passive.MinRequests < 0 {
+			_this.addf("%s.Passive: counts must not be negative", field)
+		}
+		_this.nonNegative(field+".Passive.Window", passive.Window)
+		_this.nonNegative(field+".Passive.EjectionTime", passive.EjectionTime)
+	}
+}
+
+func (_this *validator) retry(field string, retry RetryConfig) {
+	if retry.MaxAttempts < 0 || retry.MinRetries < 0 {
+		_this.addf("%s: counts must not be negative", field)
+	}
+	_this.nonNegative(field+".InitialBackoff", retry.InitialBackoff)
+	_this.nonNegative(field+".MaxBackoff", retry.MaxBackoff)
+	_this.nonNegative(field+".BudgetWindow", retry.BudgetWindow)
+	for _, status := range retry.RetryableStatuses {
+		if status < 100 || status > 599 {
+			_this.addf("%s.RetryableStatuses: %d is not an HTTP status", field, status)
+		}
+	}
+	if retry.Budget < 0 || retry.Budget > 1 {
+		_this.addf("%s.Budget: %v is not within [0, 1]", field, retry.Budget)
+	}
+}
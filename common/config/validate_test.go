@@ -0,0 +1,180 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig is the smallest config that passes validation
+func validConfig() *Config {
+	return &Config{
+		Proxy: ProxyConfig{
+			ListenPort:   "8080",
+			TargetURLs:   []string{"http://localhost:8081"},
+			LoadBalancer: LoadBalancerConfig{Strategy: "round_robin"},
+			Host:         UpstreamHostConfig{Mode: "target"},
+			TLS:          ListenerTLSConfig{MinVersion: "1.2"},
+			MirrorQueue:  MirrorQueueConfig{Workers: 1, Size: 1, OverflowPolicy: "drop_newest"},
+		},
+		Metrics: MetricsConfig{
+			ListenPort: "9464",
+			TLS:        ListenerTLSConfig{MinVersion: "1.2"},
+		},
+		Health: HealthConfig{Interval: time.Second},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		// want lists every reported problem in order, none for a valid config
+		want []string
+	}{
+		{
+			name:   "valid config",
+			modify: func(cfg *Config) {},
+		},
+		{
+			name: "every problem is reported",
+			modify: func(cfg *Config) {
+				cfg.Proxy.TargetURLs = nil
+				cfg.Proxy.ListenPort = "http"
+				cfg.Proxy.MirrorQueue.Workers = 0
+				cfg.Health.Interval = 0
+			},
+			want: []string{
+				"Proxy.TargetURL or Proxy.TargetURLs is required",
+				`Proxy.ListenPort: "http" is not a valid port`,
+				"Proxy.MirrorQueue.Workers must be positive",
+				"Health.Interval must be positive",
+			},
+		},
+		{
+			name: "listeners on the same port",
+			modify: func(cfg *Config) {
+				cfg.Metrics.ListenPort = "8080"
+			},
+			want: []string{"Proxy.ListenPort and Metrics.ListenPort both use port 8080"},
+		},
+		{
+			name: "methods are checked regardless of case",
+			modify: func(cfg *Config) {
+				cfg.Proxy.AllowedMethods = []string{"get", "GTE"}
+				cfg.Proxy.DeniedMethods = []string{"connect"}
+			},
+			want: []string{
+				`Proxy.AllowedMethods[1]: "GTE" must be one of GET, HEAD, POST, PUT, PATCH, DELETE, CONNECT, OPTIONS, TRACE`,
+			},
+		},
+		{
+			name: "mirrors",
+			modify: func(cfg *Config) {
+				rate := 2.0
+				cfg.Proxy.Mirrors = []MirrorConfig{
+					{Name: "canary", URL: "http://canary:7007", Upgrades: "skip"},
+					{Name: "canary", URL: "ftp://canary", Upgrades: "skip", SampleRate: &rate, SampleKey: "cookie:id"},
+				}
+			},
+			want: []string{
+				`Proxy.Mirrors[1]: duplicate mirror name "canary"`,
+				`Proxy.Mirrors[1].URL: "ftp://canary" must be an absolute http(s) URL`,
+				"Proxy.Mirrors[1].SampleRate: 2 is not within [0, 1]",
+				`Proxy.Mirrors[1].SampleKey: invalid key "cookie:id"`,
+			},
+		},
+		{
+			name: "circuit breaker",
+			modify: func(cfg *Config) {
+				cfg.Proxy.Mirrors = []MirrorConfig{{
+					Name:           "canary",
+					URL:            "http://canary:7007",
+					Upgrades:       "skip",
+					CircuitBreaker: CircuitBreakerConfig{Enabled: true, ErrorRate: 1.5, Window: -time.Second},
+				}}
+			},
+			want: []string{
+				"Proxy.Mirrors[0].CircuitBreaker.ErrorRate: 1.5 is not within [0, 1]",
+				"Proxy.Mirrors[0].CircuitBreaker.HalfOpenRequests must be at least 1",
+				"Proxy.Mirrors[0].CircuitBreaker.Window must not be negative",
+			},
+		},
+		{
+			name: "routes",
+			modify: func(cfg *Config) {
+				cfg.Proxy.Routes = []RouteConfig{{
+					Name:         DefaultRouteName,
+					TargetURLs:   []string{"http://localhost:8082", "http://localhost:8082"},
+					LoadBalancer: LoadBalancerConfig{Strategy: "consistent_hash"},
+					Host:         UpstreamHostConfig{Mode: "override"},
+					Mirrors:      []string{"missing"},
+				}}
+			},
+			want: []string{
+				`Proxy.Routes[0]: duplicate route name "default"`,
+				`Proxy.Routes[0].TargetURLs: duplicate backend "http://localhost:8082"`,
+				"Proxy.Routes[0].LoadBalancer.HashKey is required by consistent_hash",
+				"Proxy.Routes[0].Host.Value is required by override",
+				`Proxy.Routes[0].Mirrors: unknown mirror "missing"`,
+			},
+		},
+		{
+			name: "routes without a default target",
+			modify: func(cfg *Config) {
+				cfg.Proxy.TargetURLs = nil
+				cfg.Proxy.LoadBalancer.Strategy = ""
+				cfg.Proxy.Routes = []RouteConfig{{
+					Name:         "api",
+					TargetURLs:   []string{"http://localhost:8082"},
+					LoadBalancer: LoadBalancerConfig{Strategy: "round_robin"},
+					Host:         UpstreamHostConfig{Mode: "target"},
+				}}
+			},
+		},
+		{
+			name: "backend health and retries",
+			modify: func(cfg *Config) {
+				cfg.Proxy.BackendHealth.Active = ActiveHealthCheckConfig{Enabled: true, ExpectedStatuses: []int{200, 42}}
+				cfg.Proxy.Retry = RetryConfig{MaxAttempts: 3, RetryableStatuses: []int{503}, Budget: 1.5}
+			},
+			want: []string{
+				"Proxy.BackendHealth.Active.Interval must be positive",
+				"Proxy.BackendHealth.Active.ExpectedStatuses: 42 is not an HTTP status",
+				"Proxy.Retry.Budget: 1.5 is not within [0, 1]",
+			},
+		},
+		{
+			name: "recording",
+			modify: func(cfg *Config) {
+				cfg.Recording = RecordingConfig{Enabled: true, Format: "csv", QueueSize: 1}
+			},
+			want: []string{
+				"Recording.Directory is required when recording is enabled",
+				`Recording.Format: "csv" must be one of jsonl, har`,
+			},
+		},
+		{
+			name: "log level",
+			modify: func(cfg *Config) {
+				cfg.LogLevel = "verbose"
+			},
+			want: []string{`LogLevel: unrecognized level: "verbose"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.modify(cfg)
+
+			var got []string
+			if err := cfg.Validate(); err != nil {
+				got = strings.Split(err.Error(), "\n")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
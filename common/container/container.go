@@ -43,6 +43,21 @@ func BuildContainer(ctx context.Context) (*dig.Container, error) {
 		return nil, err
 	}
 
+	// The health and backends controllers only read the state of the proxy controller
+	if err = container.Provide(func(proxy controllers.ProxyController) controllers.ProxyStateSource {
+		return proxy
+	}); err != nil {
+		return nil, err
+	}
+
+	if err = container.Provide(controllers.NewHealthController); err != nil {
+		return nil, err
+	}
+
+	if err = container.Provide(controllers.NewBackendsController); err != nil {
+		return nil, err
+	}
+
 	// Provide server
 	if err = container.Provide(server.NewServer); err != nil {
 		return nil, err
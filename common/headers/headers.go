@@ -0,0 +1,64 @@
+package headers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	TraceIDHeader        = "X-Trace-ID"
+	ProxiedByHeader      = "X-Proxied-By"
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	ForwardedHeader      = "Forwarded"
+	ForwardedForHeader   = "X-Forwarded-For"
+	ForwardedProtoHeader = "X-Forwarded-Proto"
+	ForwardedHostHeader  = "X-Forwarded-Host"
+	ConnectionHeader     = "Connection"
+	UpgradeHeader        = "Upgrade"
+)
+
+// hopByHop are the connection-specific headers of RFC 9110 section 7.6.1, which apply to a single connection and
+// must not be forwarded. Proxy-Connection is not standard but still sent by some clients.
+var hopByHop = []string{
+	ConnectionHeader,
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	UpgradeHeader,
+}
+
+// TraceID returns the trace ID carried by the headers, generating a new one if there is none
+func TraceID(h http.Header) string {
+	if traceID := h.Get(TraceIDHeader); traceID != "" {
+		return traceID
+	}
+	return uuid.New().String()
+}
+
+// Copy copies all headers from src into dst, sharing the value slices
+func Copy(dst, src http.Header) {
+	for k, vv := range src {
+		dst[k] = vv
+	}
+}
+
+// RemoveHopByHop deletes the hop-by-hop headers from h, along with the headers listed in its Connection header
+func RemoveHopByHop(h http.Header) {
+	for _, value := range h.Values(ConnectionHeader) {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHop {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,64 @@
+package headers
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRemoveHopByHop(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   http.Header
+	}{
+		{
+			name:   "end-to-end headers are kept",
+			header: http.Header{"Accept": {"*/*"}, "Authorization": {"Bearer t"}},
+			want:   http.Header{"Accept": {"*/*"}, "Authorization": {"Bearer t"}},
+		},
+		{
+			name: "standard hop-by-hop headers are removed",
+			header: http.Header{
+				"Accept":              {"*/*"},
+				"Connection":          {"keep-alive"},
+				"Keep-Alive":          {"timeout=5"},
+				"Proxy-Authorization": {"Basic x"},
+				"Proxy-Connection":    {"keep-alive"},
+				"Te":                  {"trailers"},
+				"Trailer":             {"Expires"},
+				"Transfer-Encoding":   {"chunked"},
+				"Upgrade":             {"websocket"},
+			},
+			want: http.Header{"Accept": {"*/*"}},
+		},
+		{
+			name: "headers listed in Connection are removed",
+			header: http.Header{
+				"Accept":     {"*/*"},
+				"Connection": {"X-Hop, x-other ,", "X-Third"},
+				"X-Hop":      {"1"},
+				"X-Other":    {"2"},
+				"X-Third":    {"3"},
+				"X-Kept":     {"4"},
+			},
+			want: http.Header{"Accept": {"*/*"}, "X-Kept": {"4"}},
+		},
+		{
+			name: "Connection can't remove end-to-end headers it doesn't list",
+			header: http.Header{
+				"Connection":   {"close"},
+				"Content-Type": {"application/json"},
+			},
+			want: http.Header{"Content-Type": {"application/json"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			RemoveHopByHop(tt.header)
+			if !reflect.DeepEqual(tt.header, tt.want) {
+				t.Errorf("got %v, want %v", tt.header, tt.want)
+			}
+		})
+	}
+}
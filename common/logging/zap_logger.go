@@ -8,11 +8,15 @@ import (
 	"gopkg.in/yaml.v3"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 //go:embed zap_logger.yml
 var zapYamlFile embed.FS
 
+// level is shared by all loggers so it can be changed at runtime
+var level = zap.NewAtomicLevelAt(zap.InfoLevel)
+
 func NewLogger() Logger {
 	configYaml, err := zapYamlFile.ReadFile("zap_logger.yml")
 	if err != nil {
@@ -23,13 +27,10 @@ func NewLogger() Logger {
 		log.Fatalf("logger: failed to unmarshal zap logger configuration: %s", err)
 	}
 
-	level := zap.NewAtomicLevelAt(zap.InfoLevel)
 	logLevel := os.Getenv("LOG_LEVEL")
 	if len(logLevel) > 0 {
-		if parsedLevel, err := zap.ParseAtomicLevel(logLevel); err != nil {
+		if err = SetLevel(logLevel); err != nil {
 			log.Fatalf("logger: error parsing log level %s: %v", logLevel, err)
-		} else {
-			level = parsedLevel
 		}
 	}
 	zapConfig.Level = level
@@ -38,3 +39,13 @@ func NewLogger() Logger {
 	sugaredLogger := baseLogger.Sugar()
 	return sugaredLogger
 }
+
+// SetLevel changes the level of all loggers, e.g. "debug" or "warn"
+func SetLevel(logLevel string) error {
+	parsedLevel, err := zapcore.ParseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	level.SetLevel(parsedLevel)
+	return nil
+}
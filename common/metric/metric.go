@@ -11,20 +11,43 @@ import (
 
 type MetricService interface {
 	GetPrometheusHandler() gin.HandlerFunc
-	RecordRequest(ctx context.Context, name, method, path string, attrs ...attribute.KeyValue) error
-	RecordDuration(ctx context.Context, name, method, path string, duration time.Duration, attrs ...attribute.KeyValue) error
+	RecordRequest(ctx context.Context, name, method, route string, attrs ...attribute.KeyValue) error
+	RecordDuration(ctx context.Context, name, method, route string, duration time.Duration, attrs ...attribute.KeyValue) error
 	RecordGauge(ctx context.Context, name string, value float64, attrs ...attribute.KeyValue) error
+	RecordCount(ctx context.Context, name string, attrs ...attribute.KeyValue) error
 }
 
 const (
 	// Core proxy/mirror operation metrics
-	MetricProxy  = "proxy"  // Base metric for proxy operations
-	MetricMirror = "mirror" // Base metric for mirror operations
+	MetricProxy        = "proxy"         // Base metric for proxy operations
+	MetricMirror       = "mirror"        // Base metric for mirror operations
+	MetricProxyRetries = "proxy_retries" // For retried proxy requests, and retries denied by the budget
+	MetricProxyUpgrade = "proxy_upgrade" // For upgraded connections (e.g. WebSockets) and their lifetime
+
+	// Mirror traffic shaping metrics
+	MetricMirrorSampling     = "mirror_sampling"      // For mirror sampling decisions
+	MetricMirrorQueueDepth   = "mirror_queue_depth"   // For mirror requests waiting for a worker
+	MetricMirrorDropped      = "mirror_dropped"       // For mirror requests dropped on queue overflow, open circuit or unusable body
+	MetricMirrorCircuitState = "mirror_circuit_state" // For mirror circuit breaker state (0 closed, 1 half-open, 2 open)
+
+	// Shadow comparison metrics
+	MetricMirrorCompare  = "mirror_compare"  // For compared primary/mirror response pairs
+	MetricMirrorMismatch = "mirror_mismatch" // For differences between primary and mirror responses
+
+	// Traffic recording metrics
+	MetricRecording = "recording" // For recorded requests by result (written, dropped, error, body_too_large, body_incomplete)
 
 	// Connection tracking metrics
 	MetricProxyConnections  = "proxy_connections"  // For active proxy connections
 	MetricMirrorConnections = "mirror_connections" // For active mirror connections
 
+	// Upstream health metrics
+	MetricUpstreamHealthy = "upstream_healthy" // For upstream reachability (1 healthy, 0 unhealthy)
+	MetricBackendHealthy  = "backend_healthy"  // For backends in rotation (1 healthy, 0 ejected or failing checks)
+
+	// TLS metrics
+	MetricTLSCertificateExpiry = "tls_certificate_expiry_days" // For the days left until a served certificate expires
+
 	// System metrics
 	MetricPanics = "panics" // For system panic tracking
 )
@@ -3,7 +3,6 @@ package metric
 import (
 	"context"
 	"fmt"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,6 +22,18 @@ import (
 
 var _ MetricService = &otelMetricService{}
 
+// gaugeData holds an observable gauge and the latest value recorded for each attribute set
+type gaugeData struct {
+	gauge  metric.Float64ObservableGauge
+	values sync.Map // attribute.Distinct -> *gaugeValue
+	once   sync.Once
+}
+
+type gaugeValue struct {
+	attrs attribute.Set
+	value atomic.Value
+}
+
 type otelMetricService struct {
 	meterProvider *sdk.MeterProvider
 	meter         metric.Meter
@@ -57,32 +68,7 @@ func (_this *otelMetricService) GetPrometheusHandler() gin.HandlerFunc {
 	return gin.WrapH(promhttp.Handler())
 }
 
-// Add path normalization rules
-func normalizePath(path string) string {
-	// Split path into segments
-	segments := strings.Split(strings.TrimPrefix(path, "/api/v0/"), "/")
-
-	if len(segments) == 0 {
-		return "/"
-	}
-
-	// Define patterns to normalize
-	firstSegment := segments[0]
-	switch firstSegment {
-	case "node":
-		return "/node"
-	case "streams":
-		return "/streams"
-	default:
-		// For paths that don't match any patterns
-		return "/other"
-	}
-}
-
-func (_this *otelMetricService) RecordRequest(ctx context.Context, name, method, path string, attrs ...attribute.KeyValue) error {
-	// Normalize the path before recording metrics
-	normalizedPath := normalizePath(path)
-
+func (_this *otelMetricService) RecordRequest(ctx context.Context, name, method, route string, attrs ...attribute.KeyValue) error {
 	counter, err := _this.meter.Int64Counter(
 		fmt.Sprintf("%s_%s_requests_total", config.ServiceName, name),
 		metric.WithDescription("Total number of requests received"),
@@ -93,16 +79,13 @@ func (_this *otelMetricService) RecordRequest(ctx context.Context, name, method,
 
 	defaultAttrs := []attribute.KeyValue{
 		attribute.String("method", method),
-		attribute.String("path", normalizedPath), // Use normalized path
+		attribute.String("route", route), // Route names keep the cardinality bounded, unlike raw paths
 	}
 	counter.Add(ctx, 1, metric.WithAttributes(append(defaultAttrs, attrs...)...))
 	return nil
 }
 
-func (_this *otelMetricService) RecordDuration(ctx context.Context, name, method, path string, duration time.Duration, attrs ...attribute.KeyValue) error {
-	// Normalize the path before recording metrics
-	normalizedPath := normalizePath(path)
-
+func (_this *otelMetricService) RecordDuration(ctx context.Context, name, method, route string, duration time.Duration, attrs ...attribute.KeyValue) error {
 	histogram, err := _this.meter.Float64Histogram(
 		fmt.Sprintf("%s_%s_duration_seconds", config.ServiceName, name),
 		metric.WithDescription("Duration of operation in seconds"),
@@ -113,36 +96,45 @@ func (_this *otelMetricService) RecordDuration(ctx context.Context, name, method
 
 	defaultAttrs := []attribute.KeyValue{
 		attribute.String("method", method),
-		attribute.String("path", normalizedPath), // Use normalized path
+		attribute.String("route", route), // Route names keep the cardinality bounded, unlike raw paths
 	}
 	histogram.Record(ctx, duration.Seconds(), metric.WithAttributes(append(defaultAttrs, attrs...)...))
 	return nil
 }
 
+// RecordCount increments a counter named after the metric, for events that aren't requests
+func (_this *otelMetricService) RecordCount(ctx context.Context, name string, attrs ...attribute.KeyValue) error {
+	counter, err := _this.meter.Int64Counter(
+		fmt.Sprintf("%s_%s_total", config.ServiceName, name),
+		metric.WithDescription("Total number of events"),
+	)
+	if err != nil {
+		return err
+	}
+
+	counter.Add(ctx, 1, metric.WithAttributes(attrs...))
+	return nil
+}
+
 func (_this *otelMetricService) RecordGauge(ctx context.Context, name string, value float64, attrs ...attribute.KeyValue) error {
 	gaugeKey := fmt.Sprintf("%s_%s", config.ServiceName, name)
 
-	gaugeInterface, _ := _this.gauges.LoadOrStore(gaugeKey, &struct {
-		gauge metric.Float64ObservableGauge
-		value atomic.Value
-		once  sync.Once
-	}{})
-
-	gaugeData := gaugeInterface.(*struct {
-		gauge metric.Float64ObservableGauge
-		value atomic.Value
-		once  sync.Once
-	})
+	gaugeInterface, _ := _this.gauges.LoadOrStore(gaugeKey, &gaugeData{})
+	data := gaugeInterface.(*gaugeData)
 
-	gaugeData.once.Do(func() {
+	data.once.Do(func() {
 		gauge, err := _this.meter.Float64ObservableGauge(
 			gaugeKey,
 			metric.WithDescription("Gauge measurement"),
 			metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
-				val := gaugeData.value.Load()
-				if val != nil {
-					o.Observe(val.(float64), metric.WithAttributes(attrs...))
-				}
+				// Observe the latest value of every attribute set recorded for this gauge
+				data.values.Range(func(_, v any) bool {
+					gv := v.(*gaugeValue)
+					if val := gv.value.Load(); val != nil {
+						o.Observe(val.(float64), metric.WithAttributeSet(gv.attrs))
+					}
+					return true
+				})
 				return nil
 			}),
 		)
@@ -150,10 +142,12 @@ func (_this *otelMetricService) RecordGauge(ctx context.Context, name string, va
 			_this.logger.Errorw("failed to create gauge", "error", err)
 			return
 		}
-		gaugeData.gauge = gauge
+		data.gauge = gauge
 	})
 
-	// Store the new value directly
-	gaugeData.value.Store(value)
+	// Store the new value for this attribute set
+	attrSet := attribute.NewSet(attrs...)
+	valueInterface, _ := data.values.LoadOrStore(attrSet.Equivalent(), &gaugeValue{attrs: attrSet})
+	valueInterface.(*gaugeValue).value.Store(value)
 	return nil
 }
@@ -0,0 +1,158 @@
+package recording
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/3box/go-proxy/common/config"
+)
+
+// HAR 1.2 structures, limited to the fields needed to replay traffic. See http://www.softwareishard.com/blog/har-12-spec/
+
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	TraceID         string      `json:"_traceId,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func newHARCreator() harCreator {
+	return harCreator{Name: config.ServiceName}
+}
+
+func toHAREntry(rec *Record) harEntry {
+	requestURL := url.URL{Scheme: "http", Host: rec.Host, Path: rec.Path, RawQuery: rec.Query}
+	entry := harEntry{
+		StartedDateTime: rec.Timestamp.UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		Request: harRequest{
+			Method:      rec.Method,
+			URL:         requestURL.String(),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     toHARNameValues(rec.Header),
+			QueryString: toHARNameValues(requestURL.Query()),
+			HeadersSize: -1,
+			BodySize:    len(rec.Body),
+		},
+		Response: harResponse{
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HTTPVersion: "HTTP/1.1",
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		TraceID: rec.TraceID,
+	}
+	if len(rec.Body) > 0 {
+		text, encoding := encodeHARText(rec.Body)
+		entry.Request.PostData = &harPostData{
+			MimeType: rec.Header.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+		}
+	}
+	if rec.Response != nil {
+		text, encoding := encodeHARText(rec.Response.Body)
+		entry.Response.Status = rec.Response.StatusCode
+		entry.Response.StatusText = http.StatusText(rec.Response.StatusCode)
+		entry.Response.Headers = toHARNameValues(rec.Response.Header)
+		entry.Response.Content = harContent{
+			Size:     len(rec.Response.Body),
+			MimeType: rec.Response.Header.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+		}
+		entry.Response.BodySize = len(rec.Response.Body)
+		entry.Time = float64(rec.Response.Duration.Microseconds()) / 1000
+		entry.Timings.Wait = entry.Time
+	}
+	return entry
+}
+
+func toHARNameValues(values map[string][]string) []harNameValue {
+	nameValues := make([]harNameValue, 0, len(values))
+	for name, vv := range values {
+		for _, v := range vv {
+			nameValues = append(nameValues, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(nameValues, func(i, j int) bool {
+		return nameValues[i].Name < nameValues[j].Name
+	})
+	return nameValues
+}
+
+// encodeHARText keeps text bodies readable and base64-encodes binary ones
+func encodeHARText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
@@ -0,0 +1,141 @@
+package recording
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Reader reads back the records of a file written by Writer. The format is detected from the file extension.
+type Reader struct {
+	file    *os.File
+	gzip    *gzip.Reader
+	decoder *json.Decoder
+	entries []harEntry
+}
+
+func NewReader(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &Reader{file: file}
+	var in io.Reader = bufio.NewReader(file)
+	name := filepath.Base(path)
+	if strings.HasSuffix(name, ".gz") {
+		if reader.gzip, err = gzip.NewReader(in); err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("failed to open compressed recording: %w", err)
+		}
+		in = reader.gzip
+		name = strings.TrimSuffix(name, ".gz")
+	}
+
+	switch filepath.Ext(name) {
+	case "." + FormatHAR:
+		// HAR files are a single document, read all entries up front
+		var log harLog
+		if err = json.NewDecoder(in).Decode(&log); err != nil {
+			_ = reader.Close()
+			return nil, fmt.Errorf("failed to decode HAR recording: %w", err)
+		}
+		reader.entries = log.Log.Entries
+	case "." + FormatJSONL:
+		reader.decoder = json.NewDecoder(in)
+	default:
+		_ = reader.Close()
+		return nil, fmt.Errorf("unknown recording format for %s", path)
+	}
+	return reader, nil
+}
+
+// Next returns the next record, or io.EOF once all records were read
+func (_this *Reader) Next() (*Record, error) {
+	if _this.decoder != nil {
+		var rec Record
+		if err := _this.decoder.Decode(&rec); err != nil {
+			return nil, err
+		}
+		return &rec, nil
+	}
+
+	if len(_this.entries) == 0 {
+		return nil, io.EOF
+	}
+	entry := _this.entries[0]
+	_this.entries = _this.entries[1:]
+	return fromHAREntry(entry)
+}
+
+func (_this *Reader) Close() error {
+	if _this.gzip != nil {
+		_ = _this.gzip.Close()
+	}
+	return _this.file.Close()
+}
+
+func fromHAREntry(entry harEntry) (*Record, error) {
+	requestURL, err := url.Parse(entry.Request.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HAR request URL: %w", err)
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, entry.StartedDateTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HAR start time: %w", err)
+	}
+
+	rec := &Record{
+		Timestamp: timestamp,
+		TraceID:   entry.TraceID,
+		Method:    entry.Request.Method,
+		Host:      requestURL.Host,
+		Path:      requestURL.Path,
+		Query:     requestURL.RawQuery,
+		Header:    fromHARNameValues(entry.Request.Headers),
+	}
+	if entry.Request.PostData != nil {
+		if rec.Body, err = decodeHARText(entry.Request.PostData.Text, entry.Request.PostData.Encoding); err != nil {
+			return nil, err
+		}
+	}
+	if entry.Response.Status != 0 {
+		rec.Response = &Response{
+			StatusCode: entry.Response.Status,
+			Header:     fromHARNameValues(entry.Response.Headers),
+			Duration:   time.Duration(entry.Time * float64(time.Millisecond)),
+		}
+		if rec.Response.Body, err = decodeHARText(entry.Response.Content.Text, entry.Response.Content.Encoding); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+func fromHARNameValues(nameValues []harNameValue) http.Header {
+	header := make(http.Header, len(nameValues))
+	for _, nv := range nameValues {
+		header[nv.Name] = append(header[nv.Name], nv.Value)
+	}
+	return header
+}
+
+func decodeHARText(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		body, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 HAR body: %w", err)
+		}
+		return body, nil
+	}
+	return []byte(text), nil
+}
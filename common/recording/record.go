@@ -0,0 +1,32 @@
+package recording
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	FormatJSONL = "jsonl"
+	FormatHAR   = "har"
+)
+
+// Record is a single captured request, optionally with the primary response it got
+type Record struct {
+	Timestamp time.Time   `json:"timestamp"`
+	TraceID   string      `json:"trace_id"`
+	Route     string      `json:"route,omitempty"`
+	Method    string      `json:"method"`
+	Host      string      `json:"host"`
+	Path      string      `json:"path"`
+	Query     string      `json:"query,omitempty"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body,omitempty"`
+	Response  *Response   `json:"response,omitempty"`
+}
+
+type Response struct {
+	StatusCode int           `json:"status_code"`
+	Header     http.Header   `json:"header"`
+	Body       []byte        `json:"body,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
@@ -0,0 +1,117 @@
+package recording
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/3box/go-proxy/common/config"
+)
+
+func TestWriteReadRoundTrip(t *testing.T) {
+	timestamp := time.Date(2024, 5, 1, 12, 30, 45, 123_000_000, time.UTC)
+	records := []*Record{
+		{
+			Timestamp: timestamp,
+			TraceID:   "trace-1",
+			Method:    http.MethodPost,
+			Host:      "api.example",
+			Path:      "/api/v0/streams",
+			Query:     "a=1&b=two",
+			Header:    http.Header{"Content-Type": {"application/json"}, "X-Multi": {"1", "2"}},
+			Body:      []byte(`{"hello":"world"}`),
+			Response: &Response{
+				StatusCode: http.StatusCreated,
+				Header:     http.Header{"Content-Type": {"application/json"}},
+				Body:       []byte(`{"id":1}`),
+				Duration:   12345 * time.Microsecond,
+			},
+		},
+		{
+			Timestamp: timestamp.Add(time.Second),
+			TraceID:   "trace-2",
+			Method:    http.MethodPut,
+			Host:      "api.example",
+			Path:      "/binary",
+			Header:    http.Header{"Content-Type": {"application/octet-stream"}},
+			Body:      []byte{0xff, 0x00, 0xfe},
+		},
+		{
+			Timestamp: timestamp.Add(2 * time.Second),
+			TraceID:   "trace-3",
+			Method:    http.MethodGet,
+			Host:      "api.example",
+			Path:      "/",
+			Header:    http.Header{},
+		},
+	}
+
+	tests := []struct {
+		format   string
+		compress bool
+	}{
+		{format: FormatJSONL},
+		{format: FormatJSONL, compress: true},
+		{format: FormatHAR},
+		{format: FormatHAR, compress: true},
+	}
+	for _, tt := range tests {
+		name := tt.format
+		if tt.compress {
+			name += ".gz"
+		}
+		t.Run(name, func(t *testing.T) {
+			directory := t.TempDir()
+			writer, err := NewWriter(config.RecordingConfig{Directory: directory, Format: tt.format, Compress: tt.compress})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rec := range records {
+				if err = writer.Write(rec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			files, err := filepath.Glob(filepath.Join(directory, "traffic-*."+name))
+			if err != nil || len(files) != 1 {
+				t.Fatalf("got files %v, error %v", files, err)
+			}
+			info, err := os.Stat(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := info.Mode().Perm(); mode != 0o600 {
+				t.Errorf("got mode %o, want 600", mode)
+			}
+
+			reader, err := NewReader(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			for i, want := range records {
+				got, err := reader.Next()
+				if err != nil {
+					t.Fatalf("record %d: %v", i, err)
+				}
+				if !got.Timestamp.Equal(want.Timestamp) {
+					t.Errorf("record %d: got timestamp %s, want %s", i, got.Timestamp, want.Timestamp)
+				}
+				got.Timestamp = want.Timestamp
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("record %d: got %+v, want %+v", i, got, want)
+				}
+			}
+			if _, err = reader.Next(); err != io.EOF {
+				t.Errorf("got %v after the last record, want EOF", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package recording
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/3box/go-proxy/common/config"
+)
+
+// Writer appends records to rotated JSONL or HAR files, optionally gzip-compressed. Files are named
+// traffic-<UTC time>-<sequence>.<format>[.gz] and are only complete (valid HAR, flushed gzip stream) once rotated or
+// closed.
+type Writer struct {
+	directory      string
+	format         string
+	compress       bool
+	maxFileSize    int64
+	rotateInterval time.Duration
+
+	mu       sync.Mutex
+	file     *os.File
+	gzip     *gzip.Writer
+	out      io.Writer
+	written  int64
+	entries  int
+	openedAt time.Time
+	sequence int
+}
+
+func NewWriter(cfg config.RecordingConfig) (*Writer, error) {
+	switch cfg.Format {
+	case FormatJSONL, FormatHAR:
+	default:
+		return nil, fmt.Errorf("unknown recording format %q", cfg.Format)
+	}
+	if err := os.MkdirAll(cfg.Directory, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	return &Writer{
+		directory:      cfg.Directory,
+		format:         cfg.Format,
+		compress:       cfg.Compress,
+		maxFileSize:    cfg.MaxFileSize,
+		rotateInterval: cfg.RotateInterval,
+	}, nil
+}
+
+func (_this *Writer) Write(rec *Record) error {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	if _this.file != nil && _this.shouldRotate() {
+		if err := _this.closeFile(); err != nil {
+			return err
+		}
+	}
+	if _this.file == nil {
+		if err := _this.openFile(); err != nil {
+			return err
+		}
+	}
+
+	var (
+		line []byte
+		err  error
+	)
+	if _this.format == FormatHAR {
+		line, err = json.Marshal(toHAREntry(rec))
+		if err == nil && _this.entries > 0 {
+			line = append([]byte(","), line...)
+		}
+	} else {
+		line, err = json.Marshal(rec)
+		line = append(line, '\n')
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode record: %w", err)
+	}
+
+	n, err := _this.out.Write(line)
+	_this.written += int64(n)
+	_this.entries++
+	return err
+}
+
+func (_this *Writer) Close() error {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	if _this.file == nil {
+		return nil
+	}
+	return _this.closeFile()
+}
+
+func (_this *Writer) shouldRotate() bool {
+	if _this.maxFileSize > 0 && _this.written >= _this.maxFileSize {
+		return true
+	}
+	return _this.rotateInterval > 0 && time.Since(_this.openedAt) >= _this.rotateInterval
+}
+
+func (_this *Writer) openFile() error {
+	_this.sequence++
+	name := fmt.Sprintf("traffic-%s-%04d.%s", time.Now().UTC().Format("20060102T150405Z"), _this.sequence, _this.format)
+	if _this.compress {
+		name += ".gz"
+	}
+
+	// Recordings hold request headers and bodies, so only the owner may read them
+	file, err := os.OpenFile(filepath.Join(_this.directory, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create recording file: %w", err)
+	}
+	_this.file = file
+	_this.out = file
+	if _this.compress {
+		_this.gzip = gzip.NewWriter(file)
+		_this.out = _this.gzip
+	}
+	_this.written = 0
+	_this.entries = 0
+	_this.openedAt = time.Now()
+
+	if _this.format == FormatHAR {
+		// Entries are streamed into the array, the document is terminated when the file is closed
+		creator, _ := json.Marshal(newHARCreator())
+		header := fmt.Sprintf(`{"log":{"version":"1.2","creator":%s,"entries":[`, creator)
+		if _, err = io.WriteString(_this.out, header); err != nil {
+			return fmt.Errorf("failed to write recording header: %w", err)
+		}
+	}
+	return nil
+}
+
+func (_this *Writer) closeFile() error {
+	var errs []error
+	if _this.format == FormatHAR {
+		if _, err := io.WriteString(_this.out, "]}}\n"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _this.gzip != nil {
+		if err := _this.gzip.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := _this.file.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	_this.file = nil
+	_this.gzip = nil
+	_this.out = nil
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close recording file: %v", errs)
+	}
+	return nil
+}
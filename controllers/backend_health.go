@@ -0,0 +1,321 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/3box/go-proxy/common/config"
+	"github.com/3box/go-proxy/common/metric"
+)
+
+// backendHealthSettings is the backend health config in the form the pools look it up
+type backendHealthSettings struct {
+	active             bool
+	path               string
+	interval           time.Duration
+	timeout            time.Duration
+	expectedStatuses   map[int]bool
+	healthyThreshold   int
+	unhealthyThreshold int
+
+	passive             bool
+	consecutiveFailures int
+	errorRate           float64
+	minRequests         int
+	window              time.Duration
+	ejectionTime        time.Duration
+}
+
+func newBackendHealthSettings(cfg *config.Config) *backendHealthSettings {
+	active := cfg.Proxy.BackendHealth.Active
+	passive := cfg.Proxy.BackendHealth.Passive
+	settings := &backendHealthSettings{
+		active:              active.Enabled,
+		path:                active.Path,
+		interval:            active.Interval,
+		timeout:             active.Timeout,
+		healthyThreshold:    active.HealthyThreshold,
+		unhealthyThreshold:  active.UnhealthyThreshold,
+		passive:             passive.Enabled,
+		consecutiveFailures: passive.ConsecutiveFailures,
+		errorRate:           passive.ErrorRate,
+		minRequests:         passive.MinRequests,
+		window:              passive.Window,
+		ejectionTime:        passive.EjectionTime,
+	}
+	if len(active.ExpectedStatuses) > 0 {
+		settings.expectedStatuses = make(map[int]bool, len(active.ExpectedStatuses))
+		for _, status := range active.ExpectedStatuses {
+			settings.expectedStatuses[status] = true
+		}
+	}
+	return settings
+}
+
+func (_this *backendHealthSettings) expectedStatus(status int) bool {
+	if _this.expectedStatuses == nil {
+		return status >= 200 && status < 300
+	}
+	return _this.expectedStatuses[status]
+}
+
+// backendHealth combines the active checks and the outlier detection of a backend. A backend stays in rotation
+// unless its checks are failing or it is ejected.
+type backendHealth struct {
+	mu sync.Mutex
+
+	checkFailing   bool
+	checkSuccesses int
+	checkFailures  int
+	lastCheck      time.Time
+	lastCheckError string
+
+	consecutiveFailures int
+	windowStart         time.Time
+	windowRequests      int
+	windowFailures      int
+	ejectedUntil        time.Time
+	ejections           int
+
+	// reported is the health last logged and exported, so changes are only reported once
+	reported bool
+}
+
+func newBackendHealth() *backendHealth {
+	return &backendHealth{windowStart: time.Now(), reported: true}
+}
+
+func (_this *backendHealth) healthy(now time.Time) bool {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	return _this.healthyLocked(now)
+}
+
+func (_this *backendHealth) healthyLocked(now time.Time) bool {
+	return !_this.checkFailing && !now.Before(_this.ejectedUntil)
+}
+
+// recordCheck applies the outcome of an active check, changing the check state once a threshold is reached
+func (_this *backendHealth) recordCheck(err error, settings *backendHealthSettings) {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	_this.lastCheck = time.Now()
+	if err == nil {
+		_this.lastCheckError = ""
+		_this.checkFailures = 0
+		_this.checkSuccesses++
+		if _this.checkFailing && _this.checkSuccesses >= settings.healthyThreshold {
+			_this.checkFailing = false
+		}
+		return
+	}
+
+	_this.lastCheckError = err.Error()
+	_this.checkSuccesses = 0
+	_this.checkFailures++
+	if _this.checkFailures >= settings.unhealthyThreshold {
+		_this.checkFailing = true
+	}
+}
+
+// recordResult feeds the outcome of a proxied request to the outlier detection and reports whether it ejected the
+// backend
+func (_this *backendHealth) recordResult(success bool, settings *backendHealthSettings) bool {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	now := time.Now()
+	// Requests that were in flight when the backend got ejected don't extend the ejection
+	if now.Before(_this.ejectedUntil) {
+		return false
+	}
+	if now.Sub(_this.windowStart) >= settings.window {
+		_this.windowStart = now
+		_this.windowRequests = 0
+		_this.windowFailures = 0
+	}
+	_this.windowRequests++
+	if success {
+		_this.consecutiveFailures = 0
+		return false
+	}
+	_this.consecutiveFailures++
+	_this.windowFailures++
+
+	tooManyFailures := settings.consecutiveFailures > 0 && _this.consecutiveFailures >= settings.consecutiveFailures
+	errorRateExceeded := settings.errorRate > 0 && _this.windowRequests >= settings.minRequests &&
+		float64(_this.windowFailures)/float64(_this.windowRequests) >= settings.errorRate
+	if !tooManyFailures && !errorRateExceeded {
+		return false
+	}
+
+	_this.ejectedUntil = now.Add(settings.ejectionTime)
+	_this.ejections++
+	_this.consecutiveFailures = 0
+	_this.windowStart = now
+	_this.windowRequests = 0
+	_this.windowFailures = 0
+	return true
+}
+
+// report returns the current health and whether it changed since the last report
+func (_this *backendHealth) report(now time.Time) (healthy bool, changed bool) {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	healthy = _this.healthyLocked(now)
+	changed = healthy != _this.reported
+	_this.reported = healthy
+	return healthy, changed
+}
+
+// backendStatus is a backend as shown on the admin endpoint
+type backendStatus struct {
+	Name              string     `json:"name"`
+	URL               string     `json:"url"`
+	Healthy           bool       `json:"healthy"`
+	CheckFailing      bool       `json:"check_failing"`
+	LastCheck         *time.Time `json:"last_check,omitempty"`
+	LastCheckError    string     `json:"last_check_error,omitempty"`
+	EjectedUntil      *time.Time `json:"ejected_until,omitempty"`
+	Ejections         int        `json:"ejections"`
+	ActiveConnections int64      `json:"active_connections"`
+}
+
+func (_this *backend) status(now time.Time) backendStatus {
+	_this.health.mu.Lock()
+	defer _this.health.mu.Unlock()
+
+	status := backendStatus{
+		Name:              _this.name,
+		URL:               _this.url.Redacted(),
+		Healthy:           _this.health.healthyLocked(now),
+		CheckFailing:      _this.health.checkFailing,
+		LastCheckError:    _this.health.lastCheckError,
+		Ejections:         _this.health.ejections,
+		ActiveConnections: atomic.LoadInt64(_this.activeConns),
+	}
+	if !_this.health.lastCheck.IsZero() {
+		lastCheck := _this.health.lastCheck
+		status.LastCheck = &lastCheck
+	}
+	if now.Before(_this.health.ejectedUntil) {
+		ejectedUntil := _this.health.ejectedUntil
+		status.EjectedUntil = &ejectedUntil
+	}
+	return status
+}
+
+// runBackendHealthChecks actively checks the backends of the current config and reports their health
+func (_this *proxyController) runBackendHealthChecks() {
+	for {
+		state := _this.state.Load()
+		if state.backendHealth.active {
+			_this.checkBackends(state)
+		}
+		_this.reportBackendHealth(state)
+
+		select {
+		case <-_this.ctx.Done():
+			return
+		case <-time.After(state.backendHealth.interval):
+		}
+	}
+}
+
+// checkBackends checks every backend once, through the first route sending requests to it so the check connects
+// the same way they do
+func (_this *proxyController) checkBackends(state *proxyState) {
+	var wg sync.WaitGroup
+	checked := make(map[*backend]bool, len(state.backends))
+	for _, r := range state.allRoutes() {
+		client := &http.Client{Transport: r.transport, Timeout: state.backendHealth.timeout}
+		for _, b := range r.pool.backends {
+			if checked[b] {
+				continue
+			}
+			checked[b] = true
+			wg.Add(1)
+			go func(r *route, b *backend) {
+				defer wg.Done()
+				b.health.recordCheck(_this.checkBackend(client, r, b, state.backendHealth), state.backendHealth)
+			}(r, b)
+		}
+	}
+	wg.Wait()
+}
+
+func (_this *proxyController) checkBackend(client *http.Client, r *route, b *backend, settings *backendHealthSettings) error {
+	req, err := http.NewRequestWithContext(_this.ctx, http.MethodGet, b.url.JoinPath(settings.path).String(), nil)
+	if err != nil {
+		return err
+	}
+	if host := r.checkHost(); host != "" {
+		req.Host = host
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if !settings.expectedStatus(resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// reportBackendHealth exports the health of every backend and logs the changes
+func (_this *proxyController) reportBackendHealth(state *proxyState) {
+	now := time.Now()
+	for _, b := range state.backends {
+		healthy, changed := b.health.report(now)
+		if changed {
+			status := b.status(now)
+			_this.logger.Warnw("backend health changed",
+				"backend", b.name,
+				"healthy", healthy,
+				"check_failing", status.CheckFailing,
+				"check_error", status.LastCheckError,
+				"ejected_until", status.EjectedUntil,
+			)
+		}
+		_this.recordBackendHealth(b, healthy)
+	}
+}
+
+func (_this *proxyController) recordBackendHealth(b *backend, healthy bool) {
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	_ = _this.metrics.RecordGauge(
+		_this.ctx,
+		metric.MetricBackendHealthy,
+		value,
+		attribute.String("backend", b.name),
+	)
+}
+
+// recordBackendResult feeds the outcome of a proxied request to the backend's outlier detection
+func (_this *proxyController) recordBackendResult(reqCtx requestContext, success bool) {
+	settings := reqCtx.state.backendHealth
+	if !settings.passive || !reqCtx.backend.health.recordResult(success, settings) {
+		return
+	}
+
+	_this.logger.Warnw("backend ejected",
+		"backend", reqCtx.backend.name,
+		"ejection_time", settings.ejectionTime,
+		"trace_id", reqCtx.traceID,
+	)
+	// Report right away rather than on the next check round
+	healthy, _ := reqCtx.backend.health.report(time.Now())
+	_this.recordBackendHealth(reqCtx.backend, healthy)
+}
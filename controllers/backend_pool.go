@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/3box/go-proxy/common/config"
+)
+
+type balancerStrategy string
+
+const (
+	balanceRoundRobin       balancerStrategy = "round_robin"
+	balanceLeastConnections balancerStrategy = "least_connections"
+	balanceRandomTwoChoices balancerStrategy = "random_two_choices"
+	balanceConsistentHash   balancerStrategy = "consistent_hash"
+)
+
+// ringReplicas is the number of points each backend gets on the consistent hashing ring, which evens out the share
+// of keys each backend receives
+const ringReplicas = 100
+
+// backend is a single upstream server. Routes using the same backend URL share it, so its connection count covers
+// all of its traffic.
+type backend struct {
+	// name is the backend address used in metrics and logs
+	name        string
+	url         *url.URL
+	activeConns *int64
+	health      *backendHealth
+}
+
+func newBackend(rawURL string, previous *backend) (*backend, error) {
+	backendURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend URL %q: %w", rawURL, err)
+	}
+	b := &backend{
+		name:        backendURL.Host,
+		url:         backendURL,
+		activeConns: new(int64),
+		health:      newBackendHealth(),
+	}
+	// Keep counting the requests still in flight on the previous config, and keep unhealthy backends out
+	if previous != nil {
+		b.activeConns = previous.activeConns
+		b.health = previous.health
+	}
+	return b, nil
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend *backend
+}
+
+// backendPool picks the backend each request of a route is sent to
+type backendPool struct {
+	backends []*backend
+	strategy balancerStrategy
+	hashKey  requestKeyFunc
+	// ring is sorted by hash
+	ring []ringPoint
+	next atomic.Uint64
+}
+
+func newBackendPool(rawURLs []string, cfg config.LoadBalancerConfig, backends map[string]*backend) (*backendPool, error) {
+	if len(rawURLs) == 0 {
+		return nil, fmt.Errorf("no backends")
+	}
+	pool := &backendPool{strategy: balancerStrategy(cfg.Strategy)}
+	for _, rawURL := range rawURLs {
+		pool.backends = append(pool.backends, backends[rawURL])
+	}
+
+	switch pool.strategy {
+	case balanceRoundRobin, balanceLeastConnections, balanceRandomTwoChoices:
+	case balanceConsistentHash:
+		keyFunc, err := newRequestKeyFunc(cfg.HashKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash key: %w", err)
+		}
+		pool.hashKey = keyFunc
+		for _, b := range pool.backends {
+			for i := 0; i < ringReplicas; i++ {
+				pool.ring = append(pool.ring, ringPoint{hash: hashKey(fmt.Sprintf("%s-%d", b.url, i)), backend: b})
+			}
+		}
+		sort.Slice(pool.ring, func(i, j int) bool { return pool.ring[i].hash < pool.ring[j].hash })
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q", cfg.Strategy)
+	}
+	return pool, nil
+}
+
+// pick returns the backend for a request among the healthy ones, or among all of them when none is healthy.
+// Retries pass the backends already tried, which are avoided while other healthy backends remain.
+func (_this *backendPool) pick(r *http.Request, traceID string, tried []*backend) *backend {
+	if len(_this.backends) == 1 {
+		return _this.backends[0]
+	}
+
+	now := time.Now()
+	var healthy, untried []*backend
+	for _, b := range _this.backends {
+		if !b.health.healthy(now) {
+			continue
+		}
+		healthy = append(healthy, b)
+		if !slices.Contains(tried, b) {
+			untried = append(untried, b)
+		}
+	}
+	candidates := untried
+	if len(candidates) == 0 {
+		candidates = healthy
+	}
+	if len(candidates) == 0 {
+		candidates = _this.backends
+	}
+
+	switch _this.strategy {
+	case balanceLeastConnections:
+		return _this.leastConnections(candidates)
+	case balanceRandomTwoChoices:
+		return randomTwoChoices(candidates)
+	case balanceConsistentHash:
+		if key := _this.hashKey(r, traceID); key != "" {
+			return _this.consistentHash(key, candidates)
+		}
+	}
+	return _this.roundRobin(candidates)
+}
+
+func (_this *backendPool) roundRobin(candidates []*backend) *backend {
+	return candidates[(_this.next.Add(1)-1)%uint64(len(candidates))]
+}
+
+// leastConnections starts scanning at a rotating offset so ties are spread across backends
+func (_this *backendPool) leastConnections(candidates []*backend) *backend {
+	start := int(_this.next.Add(1) - 1)
+	var best *backend
+	for i := range candidates {
+		candidate := candidates[(start+i)%len(candidates)]
+		if best == nil || atomic.LoadInt64(candidate.activeConns) < atomic.LoadInt64(best.activeConns) {
+			best = candidate
+		}
+	}
+	return best
+}
+
+// randomTwoChoices picks the less loaded of two random backends, which avoids herding on the least loaded one
+func randomTwoChoices(candidates []*backend) *backend {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	first := rand.IntN(len(candidates))
+	second := rand.IntN(len(candidates) - 1)
+	if second >= first {
+		second++
+	}
+	a, b := candidates[first], candidates[second]
+	if atomic.LoadInt64(b.activeConns) < atomic.LoadInt64(a.activeConns) {
+		return b
+	}
+	return a
+}
+
+// consistentHash sends a key to the same backend as long as the pool does not change. Keys of backends that are
+// not candidates move to the next candidate on the ring, the others keep theirs.
+func (_this *backendPool) consistentHash(key string, candidates []*backend) *backend {
+	hash := hashKey(key)
+	start := sort.Search(len(_this.ring), func(i int) bool { return _this.ring[i].hash >= hash })
+	for i := 0; i < len(_this.ring); i++ {
+		point := _this.ring[(start+i)%len(_this.ring)]
+		if slices.Contains(candidates, point.backend) {
+			return point.backend
+		}
+	}
+	return candidates[0]
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/3box/go-proxy/common/config"
+)
+
+var testBackendURLs = []string{"http://a:8080", "http://b:8080", "http://c:8080"}
+
+func newTestPool(t *testing.T, cfg config.LoadBalancerConfig, rawURLs ...string) *backendPool {
+	t.Helper()
+	backends := make(map[string]*backend, len(rawURLs))
+	for _, rawURL := range rawURLs {
+		b, err := newBackend(rawURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends[rawURL] = b
+	}
+	pool, err := newBackendPool(rawURLs, cfg, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func userRequest(user string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-User", user)
+	return r
+}
+
+func TestConsistentHash(t *testing.T) {
+	cfg := config.LoadBalancerConfig{Strategy: string(balanceConsistentHash), HashKey: "header:X-User"}
+	users := make([]string, 1000)
+	for i := range users {
+		users[i] = fmt.Sprintf("user-%d", i)
+	}
+	// assigned maps every user to a backend name while all backends are in rotation
+	assigned := make(map[string]string, len(users))
+	pool := newTestPool(t, cfg, testBackendURLs...)
+	for _, user := range users {
+		assigned[user] = pool.pick(userRequest(user), "trace", nil).name
+	}
+
+	tests := []struct {
+		name    string
+		ejected []int
+	}{
+		{name: "all backends"},
+		{name: "first backend out", ejected: []int{0}},
+		{name: "last backend out", ejected: []int{2}},
+		{name: "single backend left", ejected: []int{0, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newTestPool(t, cfg, testBackendURLs...)
+			var out []string
+			for _, i := range tt.ejected {
+				pool.backends[i].health.ejectedUntil = time.Now().Add(time.Hour)
+				out = append(out, pool.backends[i].name)
+			}
+
+			shares := make(map[string]int)
+			for _, user := range users {
+				got := pool.pick(userRequest(user), "trace", nil).name
+				shares[got]++
+				previous := assigned[user]
+				// Only the users of backends that are out move
+				if !slices.Contains(out, previous) && got != previous {
+					t.Fatalf("%s moved from %s to %s", user, previous, got)
+				}
+				if slices.Contains(out, got) {
+					t.Fatalf("%s went to %s, which is out", user, got)
+				}
+			}
+			// The replicas spread the users, no backend in rotation is starved
+			inRotation := len(testBackendURLs) - len(out)
+			for _, b := range pool.backends {
+				if share := shares[b.name]; !slices.Contains(out, b.name) && share < len(users)/inRotation/2 {
+					t.Errorf("%s got %d of %d users", b.name, share, len(users))
+				}
+			}
+		})
+	}
+}
+
+func TestPickAvoidsTriedBackends(t *testing.T) {
+	strategies := []balancerStrategy{balanceRoundRobin, balanceLeastConnections, balanceRandomTwoChoices, balanceConsistentHash}
+	for _, strategy := range strategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			pool := newTestPool(t, config.LoadBalancerConfig{Strategy: string(strategy), HashKey: "header:X-User"}, testBackendURLs...)
+			r := userRequest("alice")
+			first := pool.pick(r, "trace", nil)
+			second := pool.pick(r, "trace", []*backend{first})
+			if second == first {
+				t.Fatalf("retry went to %s again", first.name)
+			}
+			// Once every backend was tried, any of them may be picked again
+			if third := pool.pick(r, "trace", pool.backends); third == nil {
+				t.Fatalf("no backend left")
+			}
+		})
+	}
+}
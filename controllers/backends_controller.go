@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BackendsController interface {
+	// Backends lists the backends of every pool with their health
+	Backends(c *gin.Context)
+}
+
+type backendsController struct {
+	proxy ProxyStateSource
+}
+
+func NewBackendsController(proxy ProxyStateSource) BackendsController {
+	return &backendsController{proxy: proxy}
+}
+
+// Backends lists the backends of the current config with their health
+func (_this *backendsController) Backends(c *gin.Context) {
+	state := _this.proxy.CurrentState()
+	now := time.Now()
+
+	backends := make([]backendStatus, 0, len(state.backends))
+	for _, b := range state.backends {
+		backends = append(backends, b.status(now))
+	}
+	sort.Slice(backends, func(i, j int) bool { return backends[i].URL < backends[j].URL })
+	c.JSON(http.StatusOK, gin.H{"backends": backends})
+}
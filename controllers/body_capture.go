@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// bodyCapture passes a body through while keeping a copy of it, as long as it stays within the limit
+type bodyCapture struct {
+	body     io.ReadCloser
+	limit    int64
+	expected int64
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	overflow bool
+	eof      bool
+}
+
+// newBodyCapture wraps a body of the given content length, -1 when unknown
+func newBodyCapture(body io.ReadCloser, contentLength, limit int64) *bodyCapture {
+	return &bodyCapture{
+		body:     body,
+		limit:    limit,
+		expected: contentLength,
+		overflow: contentLength > limit,
+		eof:      contentLength == 0,
+	}
+}
+
+func (_this *bodyCapture) Read(p []byte) (int, error) {
+	n, err := _this.body.Read(p)
+
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+	if !_this.overflow {
+		if int64(_this.buf.Len()+n) > _this.limit {
+			// Give up on the copy, the body is still passed through
+			_this.overflow = true
+			_this.buf = bytes.Buffer{}
+		} else {
+			_this.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		_this.eof = true
+	}
+	return n, err
+}
+
+// Close leaves the wrapped body open, its owner closes it. The transport closes request bodies once it is done with
+// them, and readRest may still need what it left unread.
+func (_this *bodyCapture) Close() error {
+	return nil
+}
+
+// readRest reads what the upstream left of the body, e.g. after a dial error or an early response, so the copy is
+// complete unless the body exceeds the limit
+func (_this *bodyCapture) readRest() {
+	buf := make([]byte, streamBufferSize)
+	for {
+		_this.mu.Lock()
+		done := _this.overflow || _this.completeLocked()
+		_this.mu.Unlock()
+		if done {
+			return
+		}
+		if _, err := _this.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// bytes returns the captured body and whether it is complete, i.e. it was read to the end without exceeding the limit
+func (_this *bodyCapture) bytes() ([]byte, bool) {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	if _this.overflow {
+		return nil, false
+	}
+	return _this.buf.Bytes(), _this.completeLocked()
+}
+
+// overflowed reports whether the body exceeded the limit
+func (_this *bodyCapture) overflowed() bool {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+	return _this.overflow
+}
+
+func (_this *bodyCapture) completeLocked() bool {
+	return _this.eof || (_this.expected >= 0 && int64(_this.buf.Len()) == _this.expected)
+}
@@ -0,0 +1,211 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/3box/go-proxy/common/config"
+	"github.com/3box/go-proxy/common/logging"
+	"github.com/3box/go-proxy/common/metric"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (_this circuitState) String() string {
+	switch _this {
+	case circuitClosed:
+		return "closed"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// circuitBreaker stops traffic to a mirror that keeps failing and probes it with a few requests once OpenTimeout has
+// passed
+type circuitBreaker struct {
+	ctx     context.Context
+	name    string
+	logger  logging.Logger
+	metrics metric.MetricService
+
+	consecutiveFailureLimit int
+	errorRate               float64
+	minRequests             int
+	window                  time.Duration
+	openTimeout             time.Duration
+	halfOpenRequests        int
+
+	mu                  sync.Mutex
+	state               circuitState
+	consecutiveFailures int
+	windowStart         time.Time
+	windowRequests      int
+	windowFailures      int
+	openedAt            time.Time
+	probesInFlight      int
+	probeSuccesses      int
+	// generation changes with every state transition, so requests allowed in an earlier state don't count
+	generation uint64
+}
+
+// circuitTicket is handed out for every allowed request and ties its outcome to the state it was allowed in
+type circuitTicket struct {
+	generation uint64
+}
+
+func newCircuitBreaker(
+	ctx context.Context,
+	name string,
+	cfg config.CircuitBreakerConfig,
+	logger logging.Logger,
+	metrics metric.MetricService,
+) *circuitBreaker {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	breaker := &circuitBreaker{
+		ctx:                     ctx,
+		name:                    name,
+		logger:                  logger,
+		metrics:                 metrics,
+		consecutiveFailureLimit: cfg.ConsecutiveFailures,
+		errorRate:               cfg.ErrorRate,
+		minRequests:             cfg.MinRequests,
+		window:                  cfg.Window,
+		openTimeout:             cfg.OpenTimeout,
+		halfOpenRequests:        cfg.HalfOpenRequests,
+		windowStart:             time.Now(),
+	}
+
+	breaker.recordState()
+	return breaker
+}
+
+// open reports whether the circuit is open and not yet due for probing, without reserving a probe
+func (_this *circuitBreaker) open() bool {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	return _this.state == circuitOpen && time.Since(_this.openedAt) < _this.openTimeout
+}
+
+// allow reports whether a request may be sent. Every allowed request must be followed by a call to record with the
+// returned ticket, or to release when it was not sent after all.
+func (_this *circuitBreaker) allow() (circuitTicket, bool) {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	if _this.state == circuitOpen {
+		if time.Since(_this.openedAt) < _this.openTimeout {
+			return circuitTicket{}, false
+		}
+		_this.transition(circuitHalfOpen)
+	}
+	if _this.state == circuitHalfOpen {
+		if _this.probesInFlight >= _this.halfOpenRequests {
+			return circuitTicket{}, false
+		}
+		_this.probesInFlight++
+	}
+	return circuitTicket{generation: _this.generation}, true
+}
+
+// release gives back the probe slot of an allowed request that was not sent
+func (_this *circuitBreaker) release(ticket circuitTicket) {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	if ticket.generation == _this.generation && _this.state == circuitHalfOpen {
+		_this.probesInFlight--
+	}
+}
+
+// record reports the outcome of an allowed request. Outcomes of requests allowed before the last transition are
+// ignored: a slow request let through while closed must neither take a probe slot nor decide the probe.
+func (_this *circuitBreaker) record(ticket circuitTicket, success bool) {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	if ticket.generation != _this.generation {
+		return
+	}
+	switch _this.state {
+	case circuitHalfOpen:
+		_this.probesInFlight--
+		if !success {
+			_this.transition(circuitOpen)
+			return
+		}
+		_this.probeSuccesses++
+		if _this.probeSuccesses >= _this.halfOpenRequests {
+			_this.transition(circuitClosed)
+		}
+	case circuitClosed:
+		now := time.Now()
+		if now.Sub(_this.windowStart) >= _this.window {
+			_this.windowStart = now
+			_this.windowRequests = 0
+			_this.windowFailures = 0
+		}
+		_this.windowRequests++
+		if success {
+			_this.consecutiveFailures = 0
+			return
+		}
+		_this.consecutiveFailures++
+		_this.windowFailures++
+
+		tooManyFailures := _this.consecutiveFailureLimit > 0 && _this.consecutiveFailures >= _this.consecutiveFailureLimit
+		errorRateExceeded := _this.errorRate > 0 && _this.windowRequests >= _this.minRequests &&
+			float64(_this.windowFailures)/float64(_this.windowRequests) >= _this.errorRate
+		if tooManyFailures || errorRateExceeded {
+			_this.transition(circuitOpen)
+		}
+	default:
+		// No requests are allowed while the circuit is open
+	}
+}
+
+// transition must be called with the lock held
+func (_this *circuitBreaker) transition(to circuitState) {
+	from := _this.state
+	_this.state = to
+	_this.generation++
+	_this.consecutiveFailures = 0
+	_this.windowStart = time.Now()
+	_this.windowRequests = 0
+	_this.windowFailures = 0
+	_this.probesInFlight = 0
+	_this.probeSuccesses = 0
+	if to == circuitOpen {
+		_this.openedAt = time.Now()
+	}
+
+	_this.logger.Warnw("mirror circuit breaker state changed",
+		"mirror", _this.name,
+		"from", from.String(),
+		"to", to.String(),
+	)
+	_this.recordState()
+}
+
+func (_this *circuitBreaker) recordState() {
+	_ = _this.metrics.RecordGauge(
+		_this.ctx,
+		metric.MetricMirrorCircuitState,
+		float64(_this.state),
+		attribute.String("mirror", _this.name),
+	)
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/3box/go-proxy/common/config"
+)
+
+// breakerStep acts on a circuit breaker and checks the state it is left in. allow and deny hand out the next ticket,
+// the other actions use the ticket handed out by an earlier step.
+type breakerStep struct {
+	action string
+	ticket int
+	want   circuitState
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	consecutive := config.CircuitBreakerConfig{
+		Enabled:             true,
+		ConsecutiveFailures: 2,
+		Window:              time.Minute,
+		OpenTimeout:         time.Minute,
+		HalfOpenRequests:    1,
+	}
+	// tripped runs the breaker into the open state with its first two tickets
+	tripped := []breakerStep{
+		{action: "allow", want: circuitClosed},
+		{action: "failure", ticket: 0, want: circuitClosed},
+		{action: "allow", want: circuitClosed},
+		{action: "failure", ticket: 1, want: circuitOpen},
+	}
+
+	tests := []struct {
+		name  string
+		cfg   config.CircuitBreakerConfig
+		steps []breakerStep
+	}{
+		{
+			name:  "consecutive failures open the circuit",
+			cfg:   consecutive,
+			steps: append(tripped, breakerStep{action: "deny", want: circuitOpen}),
+		},
+		{
+			name: "a success resets the consecutive failures",
+			cfg:  consecutive,
+			steps: []breakerStep{
+				{action: "allow", want: circuitClosed},
+				{action: "failure", ticket: 0, want: circuitClosed},
+				{action: "allow", want: circuitClosed},
+				{action: "success", ticket: 1, want: circuitClosed},
+				{action: "allow", want: circuitClosed},
+				{action: "failure", ticket: 2, want: circuitClosed},
+			},
+		},
+		{
+			name: "the error rate opens the circuit once there are enough requests",
+			cfg: config.CircuitBreakerConfig{
+				Enabled:          true,
+				ErrorRate:        0.5,
+				MinRequests:      4,
+				Window:           time.Minute,
+				OpenTimeout:      time.Minute,
+				HalfOpenRequests: 1,
+			},
+			steps: []breakerStep{
+				{action: "allow", want: circuitClosed},
+				{action: "failure", ticket: 0, want: circuitClosed},
+				{action: "allow", want: circuitClosed},
+				{action: "failure", ticket: 1, want: circuitClosed},
+				{action: "allow", want: circuitClosed},
+				{action: "success", ticket: 2, want: circuitClosed},
+				{action: "allow", want: circuitClosed},
+				{action: "success", ticket: 3, want: circuitClosed},
+				{action: "allow", want: circuitClosed},
+				{action: "failure", ticket: 4, want: circuitOpen},
+			},
+		},
+		{
+			name: "a successful probe closes the circuit",
+			cfg:  consecutive,
+			steps: append(tripped,
+				breakerStep{action: "expire", want: circuitOpen},
+				breakerStep{action: "allow", want: circuitHalfOpen},
+				breakerStep{action: "deny", want: circuitHalfOpen},
+				breakerStep{action: "success", ticket: 2, want: circuitClosed},
+				breakerStep{action: "allow", want: circuitClosed},
+			),
+		},
+		{
+			name: "a failed probe opens the circuit again",
+			cfg:  consecutive,
+			steps: append(tripped,
+				breakerStep{action: "expire", want: circuitOpen},
+				breakerStep{action: "allow", want: circuitHalfOpen},
+				breakerStep{action: "failure", ticket: 2, want: circuitOpen},
+				breakerStep{action: "deny", want: circuitOpen},
+			),
+		},
+		{
+			name: "releasing a probe frees its slot",
+			cfg:  consecutive,
+			steps: append(tripped,
+				breakerStep{action: "expire", want: circuitOpen},
+				breakerStep{action: "allow", want: circuitHalfOpen},
+				breakerStep{action: "deny", want: circuitHalfOpen},
+				breakerStep{action: "release", ticket: 2, want: circuitHalfOpen},
+				breakerStep{action: "allow", want: circuitHalfOpen},
+			),
+		},
+		{
+			name: "results of requests allowed before the probe are ignored",
+			cfg:  consecutive,
+			steps: []breakerStep{
+				{action: "allow", want: circuitClosed},
+				{action: "allow", want: circuitClosed},
+				{action: "failure", ticket: 1, want: circuitClosed},
+				{action: "allow", want: circuitClosed},
+				{action: "failure", ticket: 2, want: circuitOpen},
+				{action: "expire", want: circuitOpen},
+				{action: "allow", want: circuitHalfOpen},
+				// The slow request allowed while closed neither decides the probe nor frees its slot
+				{action: "success", ticket: 0, want: circuitHalfOpen},
+				{action: "deny", want: circuitHalfOpen},
+				{action: "failure", ticket: 0, want: circuitHalfOpen},
+				{action: "release", ticket: 0, want: circuitHalfOpen},
+				{action: "deny", want: circuitHalfOpen},
+				{action: "success", ticket: 3, want: circuitClosed},
+			},
+		},
+		{
+			name: "results of probes from an earlier half-open state are ignored",
+			cfg: config.CircuitBreakerConfig{
+				Enabled:             true,
+				ConsecutiveFailures: 2,
+				Window:              time.Minute,
+				OpenTimeout:         time.Minute,
+				HalfOpenRequests:    2,
+			},
+			steps: append(tripped,
+				breakerStep{action: "expire", want: circuitOpen},
+				breakerStep{action: "allow", want: circuitHalfOpen},
+				breakerStep{action: "allow", want: circuitHalfOpen},
+				breakerStep{action: "failure", ticket: 2, want: circuitOpen},
+				breakerStep{action: "expire", want: circuitOpen},
+				breakerStep{action: "allow", want: circuitHalfOpen},
+				breakerStep{action: "success", ticket: 3, want: circuitHalfOpen},
+				breakerStep{action: "success", ticket: 4, want: circuitHalfOpen},
+				breakerStep{action: "allow", want: circuitHalfOpen},
+				breakerStep{action: "success", ticket: 5, want: circuitClosed},
+			),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := newCircuitBreaker(context.Background(), "test", tt.cfg, nopLogger{}, nopMetrics{})
+			var tickets []circuitTicket
+			for i, step := range tt.steps {
+				switch step.action {
+				case "allow", "deny":
+					ticket, allowed := breaker.allow()
+					if allowed != (step.action == "allow") {
+						t.Fatalf("step %d: got allowed %t", i, allowed)
+					}
+					tickets = append(tickets, ticket)
+				case "success", "failure":
+					breaker.record(tickets[step.ticket], step.action == "success")
+				case "release":
+					breaker.release(tickets[step.ticket])
+				case "expire":
+					breaker.openedAt = breaker.openedAt.Add(-breaker.openTimeout)
+				}
+				if breaker.state != step.want {
+					t.Fatalf("step %d (%s): got state %s, want %s", i, step.action, breaker.state, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	if breaker := newCircuitBreaker(context.Background(), "test", config.CircuitBreakerConfig{}, nopLogger{}, nopMetrics{}); breaker != nil {
+		t.Errorf("got a breaker for a disabled config")
+	}
+}
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/3box/go-proxy/common/config"
+	"github.com/3box/go-proxy/common/headers"
+)
+
+// tunnelProtocol labels CONNECT tunnels in the upgrade metrics
+const tunnelProtocol = "connect"
+
+// ProxyConnectRequest opens a tunnel to a backend of the route the request matched. The client picks neither the
+// backend nor its address, CONNECT only turns the connection into a byte stream to the backend. Tunnels are neither
+// mirrored nor recorded, and are not bound by Proxy.Timeout once established.
+func (_this *proxyController) ProxyConnectRequest(c *gin.Context) {
+	traceID := headers.TraceID(c.Request.Header)
+	state := _this.state.Load()
+	route := state.route(c.Request)
+	if route == nil {
+		_this.rejectUnrouted(c, traceID)
+		return
+	}
+	c.Set(RouteContextKey, route.name)
+
+	backend := route.pool.pick(c.Request, traceID, nil)
+	reqCtx := requestContext{
+		reqType:    proxyRequest,
+		state:      state,
+		route:      route,
+		backend:    backend,
+		ginContext: c,
+		request:    c.Request,
+		startTime:  time.Now(),
+		targetURL:  backend.url,
+		traceID:    traceID,
+	}
+
+	// The route timeout bounds connecting to the backend, the tunnel lives on once it is established
+	dialCtx, cancel := context.WithTimeout(c.Request.Context(), route.timeout)
+	backendConn, err := dialBackend(dialCtx, route, backend)
+	cancel()
+	if err != nil {
+		_this.recordBackendResult(reqCtx, false)
+		_this.recordUpgrade(reqCtx, "error", time.Since(reqCtx.startTime))
+		_this.logger.Errorw("tunnel error",
+			"error", err,
+			"backend", backend.name,
+			"trace_id", traceID,
+		)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "proxy error"})
+		return
+	}
+	defer backendConn.Close()
+	_this.recordBackendResult(reqCtx, true)
+
+	clientConn, clientBuf, err := c.Writer.Hijack()
+	if err != nil {
+		_this.recordUpgrade(reqCtx, "error", time.Since(reqCtx.startTime))
+		_this.logger.Errorw("failed to take over the client connection",
+			"error", err,
+			"trace_id", traceID,
+		)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "tunnel not supported"})
+		return
+	}
+	defer clientConn.Close()
+	// Deadlines set by the server for the request must not cut the tunnel short
+	_ = clientConn.SetDeadline(time.Time{})
+
+	if _, err = clientBuf.WriteString("HTTP/1.1 200 Connection Established\r\n" +
+		headers.ProxiedByHeader + ": " + config.ServiceName + "\r\n" +
+		headers.TraceIDHeader + ": " + traceID + "\r\n\r\n"); err == nil {
+		err = clientBuf.Flush()
+	}
+	if err != nil {
+		_this.recordUpgrade(reqCtx, "error", time.Since(reqCtx.startTime))
+		return
+	}
+
+	atomic.AddInt64(backend.activeConns, 1)
+	_this.recordActiveConnections(reqCtx)
+	defer func() {
+		atomic.AddInt64(backend.activeConns, -1)
+		_this.recordActiveConnections(reqCtx)
+	}()
+
+	_this.logger.Infow("tunnel opened",
+		"backend", backend.name,
+		"trace_id", traceID,
+	)
+	sent, received := pipeConnections(clientConn, clientBuf.Reader, backendConn)
+	duration := time.Since(reqCtx.startTime)
+	_this.recordUpgrade(reqCtx, "upgraded", duration)
+	_this.logger.Infow("tunnel closed",
+		"backend", backend.name,
+		"bytes_sent", sent,
+		"bytes_received", received,
+		"duration", duration,
+		"trace_id", traceID,
+	)
+}
+
+// dialBackend connects to a backend the way the route's transport does, speaking TLS to https backends
+func dialBackend(ctx context.Context, r *route, b *backend) (net.Conn, error) {
+	port := b.url.Port()
+	if port == "" {
+		port = "80"
+		if b.url.Scheme == "https" {
+			port = "443"
+		}
+	}
+	conn, err := r.transport.DialContext(ctx, "tcp", net.JoinHostPort(b.url.Hostname(), port))
+	if err != nil || b.url.Scheme != "https" {
+		return conn, err
+	}
+
+	tlsConfig := &tls.Config{}
+	if r.transport.TLSClientConfig != nil {
+		tlsConfig = r.transport.TLSClientConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = b.url.Hostname()
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
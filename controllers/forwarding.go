@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/3box/go-proxy/common/headers"
+)
+
+// forwardingPolicy decides which headers of a request are sent upstream. Hop-by-hop headers are dropped and the
+// forwarding headers describe the client. When the request comes from a trusted proxy the client is the one that
+// proxy reported, so the forwarding headers are extended rather than replaced.
+type forwardingPolicy struct {
+	trusted []netip.Prefix
+}
+
+func newForwardingPolicy(trustedProxies []string) (*forwardingPolicy, error) {
+	policy := &forwardingPolicy{}
+	for _, value := range trustedProxies {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		policy.trusted = append(policy.trusted, prefix.Masked())
+	}
+	return policy, nil
+}
+
+// trusts reports whether addr belongs to a trusted proxy
+func (_this *forwardingPolicy) trusts(addr netip.Addr) bool {
+	for _, prefix := range _this.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamHeader returns a copy of the request headers to send upstream
+func (_this *forwardingPolicy) upstreamHeader(r *http.Request) http.Header {
+	header := r.Header.Clone()
+	headers.RemoveHopByHop(header)
+
+	peer := remoteAddr(r)
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	element := forwardedElement(peer, r.Host, proto)
+
+	if peer.IsValid() && _this.trusts(peer) {
+		appendHeader(header, headers.ForwardedForHeader, peer.String())
+		appendHeader(header, headers.ForwardedHeader, element)
+		// The trusted proxy saw the original scheme and host, this one only sees its own
+		if header.Get(headers.ForwardedProtoHeader) == "" {
+			header.Set(headers.ForwardedProtoHeader, proto)
+		}
+		if header.Get(headers.ForwardedHostHeader) == "" {
+			header.Set(headers.ForwardedHostHeader, r.Host)
+		}
+		return header
+	}
+
+	// Whatever an untrusted client claims about earlier hops cannot be relied on
+	header.Del(headers.ForwardedForHeader)
+	if peer.IsValid() {
+		header.Set(headers.ForwardedForHeader, peer.String())
+	}
+	header.Set(headers.ForwardedHeader, element)
+	header.Set(headers.ForwardedProtoHeader, proto)
+	header.Set(headers.ForwardedHostHeader, r.Host)
+	return header
+}
+
+// remoteAddr returns the address of the peer, invalid when it is not an IP address
+func remoteAddr(r *http.Request) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr().Unmap()
+}
+
+// appendHeader adds value to the comma-separated list of a header, folding repeated fields into one
+func appendHeader(header http.Header, name, value string) {
+	header.Set(name, strings.Join(append(header.Values(name), value), ", "))
+}
+
+// forwardedElement describes a hop in the syntax of the Forwarded header, RFC 7239
+func forwardedElement(peer netip.Addr, host, proto string) string {
+	node := "unknown"
+	if peer.Is4() {
+		node = peer.String()
+	} else if peer.IsValid() {
+		node = `"[` + peer.String() + `]"`
+	}
+	return "for=" + node + ";host=" + forwardedValue(host) + ";proto=" + proto
+}
+
+// forwardedValue quotes a value unless it is a token
+func forwardedValue(value string) string {
+	if value == "" {
+		return `""`
+	}
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	return value
+}
+
+func isTokenChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestForwardingPolicyUpstreamHeader(t *testing.T) {
+	policy, err := newForwardingPolicy([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		header     http.Header
+		want       map[string]string
+	}{
+		{
+			name:       "untrusted peer replaces the forwarding headers",
+			remoteAddr: "203.0.113.7:5000",
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"spoofed.example"},
+				"Forwarded":         {"for=198.51.100.1"},
+			},
+			want: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "proxy.example",
+				"Forwarded":         "for=203.0.113.7;host=proxy.example;proto=http",
+			},
+		},
+		{
+			name:       "trusted peer extends the forwarding headers",
+			remoteAddr: "10.1.2.3:5000",
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"public.example"},
+				"Forwarded":         {"for=198.51.100.1;proto=https"},
+			},
+			want: map[string]string{
+				"X-Forwarded-For":   "198.51.100.1, 10.1.2.3",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.example",
+				"Forwarded":         "for=198.51.100.1;proto=https, for=10.1.2.3;host=proxy.example;proto=http",
+			},
+		},
+		{
+			name:       "trusted peer without forwarding headers reports itself",
+			remoteAddr: "10.1.2.3:5000",
+			tls:        true,
+			header:     http.Header{},
+			want: map[string]string{
+				"X-Forwarded-For":   "10.1.2.3",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "proxy.example",
+				"Forwarded":         "for=10.1.2.3;host=proxy.example;proto=https",
+			},
+		},
+		{
+			name:       "trusted IPv6 peer is quoted",
+			remoteAddr: "[2001:db8::1]:5000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want: map[string]string{
+				"X-Forwarded-For": "198.51.100.1, 2001:db8::1",
+				"Forwarded":       `for="[2001:db8::1]";host=proxy.example;proto=http`,
+			},
+		},
+		{
+			name:       "untrusted IPv6 peer is quoted",
+			remoteAddr: "[2001:db8::2]:5000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want: map[string]string{
+				"X-Forwarded-For": "2001:db8::2",
+				"Forwarded":       `for="[2001:db8::2]";host=proxy.example;proto=http`,
+			},
+		},
+		{
+			name:       "IPv4-mapped peer is matched as IPv4",
+			remoteAddr: "[::ffff:10.1.2.3]:5000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want: map[string]string{
+				"X-Forwarded-For": "198.51.100.1, 10.1.2.3",
+			},
+		},
+		{
+			name:       "peer that is no IP address is unknown",
+			remoteAddr: "@",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want: map[string]string{
+				"X-Forwarded-For": "",
+				"Forwarded":       "for=unknown;host=proxy.example;proto=http",
+			},
+		},
+		{
+			name:       "hop-by-hop headers are dropped",
+			remoteAddr: "203.0.113.7:5000",
+			header:     http.Header{"Connection": {"X-Hop"}, "X-Hop": {"1"}, "Keep-Alive": {"timeout=5"}},
+			want: map[string]string{
+				"Connection": "",
+				"X-Hop":      "",
+				"Keep-Alive": "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://proxy.example/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header = tt.header
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+
+			header := policy.upstreamHeader(r)
+			for name, want := range tt.want {
+				if got := header.Get(name); got != want {
+					t.Errorf("%s: got %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewForwardingPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		addr    string
+		trusts  bool
+		wantErr bool
+	}{
+		{name: "range", trusted: []string{"192.168.0.0/16"}, addr: "192.168.4.5", trusts: true},
+		{name: "range is masked", trusted: []string{"192.168.1.1/16"}, addr: "192.168.4.5", trusts: true},
+		{name: "single address", trusted: []string{"192.168.1.1"}, addr: "192.168.1.1", trusts: true},
+		{name: "other address", trusted: []string{"192.168.1.1"}, addr: "192.168.1.2", trusts: false},
+		{name: "nothing trusted", addr: "127.0.0.1", trusts: false},
+		{name: "invalid", trusted: []string{"localhost"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := newForwardingPolicy(tt.trusted)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := policy.trusts(netip.MustParseAddr(tt.addr)); got != tt.trusts {
+				t.Errorf("got %t, want %t", got, tt.trusts)
+			}
+		})
+	}
+}
+
+func TestForwardedElement(t *testing.T) {
+	tests := []struct {
+		name  string
+		peer  netip.Addr
+		host  string
+		proto string
+		want  string
+	}{
+		{"IPv4", netip.MustParseAddr("192.0.2.1"), "example.com", "http", "for=192.0.2.1;host=example.com;proto=http"},
+		{"IPv6", netip.MustParseAddr("2001:db8::1"), "example.com", "https", `for="[2001:db8::1]";host=example.com;proto=https`},
+		{"unknown peer", netip.Addr{}, "example.com", "http", "for=unknown;host=example.com;proto=http"},
+		{"host with port", netip.MustParseAddr("192.0.2.1"), "example.com:8080", "http", `for=192.0.2.1;host="example.com:8080";proto=http`},
+		{"IPv6 host", netip.MustParseAddr("192.0.2.1"), "[2001:db8::2]:443", "https", `for=192.0.2.1;host="[2001:db8::2]:443";proto=https`},
+		{"empty host", netip.MustParseAddr("192.0.2.1"), "", "http", `for=192.0.2.1;host="";proto=http`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := forwardedElement(tt.peer, tt.host, tt.proto); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"example.com", "example.com"},
+		{"", `""`},
+		{"a:b", `"a:b"`},
+		{"with space", `"with space"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+		{"token!#$%&'*+-.^_`|~", "token!#$%&'*+-.^_`|~"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := forwardedValue(tt.value); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/3box/go-proxy/common/config"
+	"github.com/3box/go-proxy/common/logging"
+	"github.com/3box/go-proxy/common/metric"
+)
+
+type HealthController interface {
+	Liveness(c *gin.Context)
+	Readiness(c *gin.Context)
+	// SetDraining makes readiness fail so load balancers stop sending traffic before shutdown
+	SetDraining()
+	// UpdateConfig switches the checks to the upstreams of a new config, the check interval only changes on restart
+	UpdateConfig(cfg *config.Config)
+}
+
+type healthController struct {
+	ctx      context.Context
+	cfg      *config.Config
+	logger   logging.Logger
+	metrics  metric.MetricService
+	proxy    ProxyStateSource
+	draining atomic.Bool
+
+	mu       sync.RWMutex
+	upstream []healthTarget
+	status   map[string]upstreamStatus
+}
+
+// healthTarget is an upstream whose reachability gates readiness. Readiness requires a healthy upstream in every
+// group, so a pool stays ready while any of its backends is.
+type healthTarget struct {
+	name  string
+	group string
+	url   string
+	// client and host reach the upstream the way proxied requests do, host is empty for the URL's host
+	client *http.Client
+	host   string
+	// backend is set for pool members, whose ejections and failing active checks make them unhealthy. The active
+	// checks already probe them when enabled, so they aren't probed twice.
+	backend *backend
+	probe   bool
+}
+
+type upstreamStatus struct {
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+func NewHealthController(
+	ctx context.Context,
+	cfg *config.Config,
+	logger logging.Logger,
+	metrics metric.MetricService,
+	proxy ProxyStateSource,
+) HealthController {
+	hc := &healthController{
+		ctx:     ctx,
+		cfg:     cfg,
+		logger:  logger,
+		metrics: metrics,
+		proxy:   proxy,
+		status:  make(map[string]upstreamStatus),
+	}
+	hc.upstream = healthTargets(cfg, proxy.CurrentState())
+
+	go hc.run()
+	return hc
+}
+
+// healthTargets lists the upstreams of the proxy state built from cfg
+func healthTargets(cfg *config.Config, state *proxyState) []healthTarget {
+	var upstream []healthTarget
+	for _, r := range state.allRoutes() {
+		group := "route:" + r.name
+		if r == state.defaultRoute {
+			group = "target"
+		}
+		upstream = append(upstream, poolHealthTargets(group, r, cfg.Health, state.backendHealth)...)
+	}
+	if cfg.Health.IncludeMirrors {
+		client := &http.Client{Transport: state.transport, Timeout: cfg.Health.Timeout}
+		for _, mirror := range state.mirrors {
+			name := "mirror:" + mirror.name
+			upstream = append(upstream, healthTarget{
+				name:   name,
+				group:  name,
+				url:    healthCheckURL(mirror.cfg.URL, cfg.Health.Path),
+				client: client,
+				host:   mirror.cfg.Transform.Host,
+				probe:  true,
+			})
+		}
+	}
+	return upstream
+}
+
+// poolHealthTargets names single backends after their pool, and pool members after their address
+func poolHealthTargets(group string, r *route, cfg config.HealthConfig, settings *backendHealthSettings) []healthTarget {
+	client := &http.Client{Transport: r.transport, Timeout: cfg.Timeout}
+	var upstream []healthTarget
+	for _, b := range r.pool.backends {
+		name := group
+		if len(r.pool.backends) > 1 {
+			name = group + ":" + b.name
+		}
+		upstream = append(upstream, healthTarget{
+			name:    name,
+			group:   group,
+			url:     healthCheckURL(b.url.String(), cfg.Path),
+			client:  client,
+			host:    r.checkHost(),
+			backend: b,
+			probe:   !settings.active,
+		})
+	}
+	return upstream
+}
+
+func healthCheckURL(baseURL, path string) string {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		// Invalid URLs are reported by the check itself
+		return baseURL + path
+	}
+	return parsed.JoinPath(path).String()
+}
+
+func (_this *healthController) run() {
+	ticker := time.NewTicker(_this.cfg.Health.Interval)
+	defer ticker.Stop()
+
+	for {
+		_this.checkAll()
+		select {
+		case <-_this.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (_this *healthController) checkAll() {
+	_this.mu.RLock()
+	upstream := _this.upstream
+	_this.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, target := range upstream {
+		wg.Add(1)
+		go func(target healthTarget) {
+			defer wg.Done()
+			_this.check(target)
+		}(target)
+	}
+	wg.Wait()
+}
+
+func (_this *healthController) check(target healthTarget) {
+	status := upstreamStatus{CheckedAt: time.Now()}
+
+	var err error
+	if target.probe {
+		err = _this.probe(target)
+	}
+	if err == nil && target.backend != nil {
+		err = backendHealthError(target.backend, target.probe, status.CheckedAt)
+	}
+	status.Healthy = err == nil
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	_this.mu.Lock()
+	previous, checked := _this.status[target.name]
+	_this.status[target.name] = status
+	_this.mu.Unlock()
+
+	if checked && previous.Healthy != status.Healthy {
+		_this.logger.Warnw("upstream health changed",
+			"upstream", target.name,
+			"url", target.url,
+			"healthy", status.Healthy,
+			"error", status.Error,
+		)
+	}
+
+	healthy := 0.0
+	if status.Healthy {
+		healthy = 1
+	}
+	_ = _this.metrics.RecordGauge(
+		_this.ctx,
+		metric.MetricUpstreamHealthy,
+		healthy,
+		attribute.String("upstream", target.name),
+	)
+}
+
+func (_this *healthController) probe(target healthTarget) error {
+	req, err := http.NewRequestWithContext(_this.ctx, http.MethodGet, target.url, nil)
+	if err != nil {
+		return err
+	}
+	if target.host != "" {
+		req.Host = target.host
+	}
+	resp, err := target.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// backendHealthError explains why a backend is out of rotation, nil while it is in rotation. Without a probe of its
+// own, readiness waits for the first active check.
+func backendHealthError(b *backend, probed bool, now time.Time) error {
+	status := b.status(now)
+	switch {
+	case !probed && status.LastCheck == nil:
+		return errors.New("waiting for the first active check")
+	case status.CheckFailing:
+		return fmt.Errorf("active check failing: %s", status.LastCheckError)
+	case status.EjectedUntil != nil:
+		return fmt.Errorf("ejected until %s", status.EjectedUntil.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (_this *healthController) Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (_this *healthController) Readiness(c *gin.Context) {
+	if _this.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+		return
+	}
+
+	_this.mu.RLock()
+	defer _this.mu.RUnlock()
+
+	groups := make(map[string]bool)
+	upstream := make(map[string]upstreamStatus, len(_this.upstream))
+	for _, target := range _this.upstream {
+		status, checked := _this.status[target.name]
+		groups[target.group] = groups[target.group] || checked && status.Healthy
+		upstream[target.name] = status
+	}
+	ready := true
+	for _, healthy := range groups {
+		ready = ready && healthy
+	}
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "upstream": upstream})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready", "upstream": upstream})
+}
+
+func (_this *healthController) SetDraining() {
+	_this.draining.Store(true)
+}
+
+func (_this *healthController) UpdateConfig(cfg *config.Config) {
+	// The proxy controller already switched to the new config
+	upstream := healthTargets(cfg, _this.proxy.CurrentState())
+
+	_this.mu.Lock()
+	_this.upstream = upstream
+	_this.mu.Unlock()
+
+	// Check right away so readiness reflects the new upstreams
+	go _this.checkAll()
+}
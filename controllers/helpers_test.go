@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// nopLogger discards everything logged by the code under test
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Debugw(string, ...interface{}) {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+func (nopLogger) Errorw(string, ...interface{}) {}
+func (nopLogger) Fatalf(string, ...interface{}) {}
+func (nopLogger) Infow(string, ...interface{})  {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Warnw(string, ...interface{})  {}
+func (nopLogger) Sync() error                   { return nil }
+
+// nopMetrics discards every metric recorded by the code under test
+type nopMetrics struct{}
+
+func (nopMetrics) GetPrometheusHandler() gin.HandlerFunc { return nil }
+func (nopMetrics) RecordRequest(context.Context, string, string, string, ...attribute.KeyValue) error {
+	return nil
+}
+func (nopMetrics) RecordDuration(context.Context, string, string, string, time.Duration, ...attribute.KeyValue) error {
+	return nil
+}
+func (nopMetrics) RecordGauge(context.Context, string, float64, ...attribute.KeyValue) error {
+	return nil
+}
+func (nopMetrics) RecordCount(context.Context, string, ...attribute.KeyValue) error { return nil }
@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/3box/go-proxy/common/config"
+	"github.com/3box/go-proxy/common/logging"
+	"github.com/3box/go-proxy/common/metric"
+)
+
+type overflowPolicy string
+
+const (
+	overflowDropNewest overflowPolicy = "drop_newest"
+	overflowDropOldest overflowPolicy = "drop_oldest"
+	overflowBlock      overflowPolicy = "block"
+)
+
+type dropReason string
+
+const (
+	dropCircuitOpen  dropReason = "circuit_open"
+	dropBlockTimeout dropReason = "block_timeout"
+	dropBodyTooLarge dropReason = "body_too_large"
+	// dropBodyIncomplete is for request bodies that could not be read to the end, e.g. because the client went away
+	dropBodyIncomplete dropReason = "body_incomplete"
+	dropUpgrade        dropReason = "upgrade"
+)
+
+// mirrorJob is a snapshot of a proxied request, taken before the gin context is recycled
+type mirrorJob struct {
+	mirror   *mirrorTarget
+	route    *route
+	method   string
+	path     string
+	rawQuery string
+	header   http.Header
+	body     []byte
+	traceID  string
+	primary  *capturedResponse
+	state    *proxyState
+}
+
+// mirrorDispatcher sends mirror requests from a bounded queue using a fixed number of workers
+type mirrorDispatcher struct {
+	ctx          context.Context
+	logger       logging.Logger
+	metrics      metric.MetricService
+	queue        chan *mirrorJob
+	policy       overflowPolicy
+	blockTimeout time.Duration
+	handler      func(*mirrorJob)
+}
+
+func newMirrorDispatcher(
+	ctx context.Context,
+	cfg config.MirrorQueueConfig,
+	logger logging.Logger,
+	metrics metric.MetricService,
+	handler func(*mirrorJob),
+) (*mirrorDispatcher, error) {
+	policy := overflowPolicy(cfg.OverflowPolicy)
+	switch policy {
+	case overflowDropNewest, overflowDropOldest, overflowBlock:
+	default:
+		return nil, fmt.Errorf("unknown mirror queue overflow policy %q", cfg.OverflowPolicy)
+	}
+	if cfg.Workers <= 0 || cfg.Size <= 0 {
+		return nil, fmt.Errorf("mirror queue workers (%d) and size (%d) must be positive", cfg.Workers, cfg.Size)
+	}
+
+	dispatcher := &mirrorDispatcher{
+		ctx:          ctx,
+		logger:       logger,
+		metrics:      metrics,
+		queue:        make(chan *mirrorJob, cfg.Size),
+		policy:       policy,
+		blockTimeout: cfg.BlockTimeout,
+		handler:      handler,
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		go dispatcher.work()
+	}
+	return dispatcher, nil
+}
+
+func (_this *mirrorDispatcher) work() {
+	for {
+		select {
+		case <-_this.ctx.Done():
+			return
+		case job := <-_this.queue:
+			_this.recordQueueDepth()
+			_this.handler(job)
+		}
+	}
+}
+
+// enqueue adds a job to the queue, applying the overflow policy when the queue is full
+func (_this *mirrorDispatcher) enqueue(job *mirrorJob) {
+	defer _this.recordQueueDepth()
+
+	select {
+	case _this.queue <- job:
+		return
+	default:
+	}
+
+	switch _this.policy {
+	case overflowDropOldest:
+		for {
+			select {
+			case _this.queue <- job:
+				return
+			default:
+			}
+			// Make room by dropping the job at the head of the queue
+			select {
+			case oldest := <-_this.queue:
+				_this.drop(oldest, dropReason(_this.policy))
+			default:
+			}
+		}
+	case overflowBlock:
+		timer := time.NewTimer(_this.blockTimeout)
+		defer timer.Stop()
+		select {
+		case _this.queue <- job:
+		case <-timer.C:
+			_this.drop(job, dropBlockTimeout)
+		case <-_this.ctx.Done():
+			_this.drop(job, dropBlockTimeout)
+		}
+	default:
+		_this.drop(job, dropReason(_this.policy))
+	}
+}
+
+func (_this *mirrorDispatcher) drop(job *mirrorJob, reason dropReason) {
+	_ = _this.metrics.RecordRequest(
+		_this.ctx,
+		metric.MetricMirrorDropped,
+		job.method,
+		job.route.name,
+		attribute.String("mirror", job.mirror.name),
+		attribute.String("reason", string(reason)),
+	)
+	_this.logger.Debugw("mirror request dropped",
+		"mirror", job.mirror.name,
+		"route", job.route.name,
+		"method", job.method,
+		"path", job.path,
+		"reason", reason,
+		"trace_id", job.traceID,
+	)
+}
+
+func (_this *mirrorDispatcher) recordQueueDepth() {
+	_ = _this.metrics.RecordGauge(
+		_this.ctx,
+		metric.MetricMirrorQueueDepth,
+		float64(len(_this.queue)),
+	)
+}
@@ -5,20 +5,21 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync/atomic"
 	"time"
 
 	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 
 	"github.com/3box/go-proxy/common/config"
+	"github.com/3box/go-proxy/common/headers"
 	"github.com/3box/go-proxy/common/logging"
 	"github.com/3box/go-proxy/common/metric"
+	"github.com/3box/go-proxy/common/recording"
 )
 
 type ProxyController interface {
@@ -27,18 +28,47 @@ type ProxyController interface {
 	ProxyPutRequest(c *gin.Context)
 	ProxyDeleteRequest(c *gin.Context)
 	ProxyOptionsRequest(c *gin.Context)
+	ProxyPatchRequest(c *gin.Context)
+	ProxyHeadRequest(c *gin.Context)
+	ProxyTraceRequest(c *gin.Context)
+	ProxyConnectRequest(c *gin.Context)
+	// UpdateConfig swaps in a new config for subsequent requests, keeping the current one if the new one is invalid.
+	// Queue and recording settings only take effect on restart.
+	UpdateConfig(cfg *config.Config) error
+	Close()
+	ProxyStateSource
+}
+
+// ProxyStateSource gives the health and admin endpoints the routes and backends requests are sent to, without access
+// to the proxy itself
+type ProxyStateSource interface {
+	CurrentState() *proxyState
 }
 
 type proxyController struct {
-	ctx               context.Context
-	cfg               *config.Config
-	logger            logging.Logger
-	metrics           metric.MetricService
-	target            *url.URL
-	mirror            *url.URL
-	client            *http.Client
-	proxyActiveConns  *int64
-	mirrorActiveConns *int64
+	ctx        context.Context
+	logger     logging.Logger
+	metrics    metric.MetricService
+	state      atomic.Pointer[proxyState]
+	dispatcher *mirrorDispatcher
+	recorder   *trafficRecorder
+	// retryBudget is shared by all routes and survives reloads
+	retryBudget *retryBudget
+}
+
+// mirrorTarget holds the state of a single named mirror
+type mirrorTarget struct {
+	name        string
+	cfg         config.MirrorConfig
+	url         *url.URL
+	timeout     time.Duration
+	client      *http.Client
+	filter      requestFilter
+	sampler     *sampler
+	transform   *requestTransform
+	comparer    *responseComparer
+	breaker     *circuitBreaker
+	activeConns *int64
 }
 
 type requestType string
@@ -48,15 +78,35 @@ const (
 	mirrorRequest requestType = "mirror"
 )
 
+// unroutedRouteName labels requests that matched no route
+const unroutedRouteName = "none"
+
 // Create a struct to hold request context
 type requestContext struct {
-	reqType    requestType
+	reqType requestType
+	state   *proxyState
+	route   *route
+	// backend is the pool member a proxied request is sent to
+	backend    *backend
+	mirror     *mirrorTarget
 	ginContext *gin.Context
 	request    *http.Request
 	bodyBytes  []byte
 	startTime  time.Time
 	targetURL  *url.URL
 	traceID    string
+	// primary is the proxied response a mirror response is compared against
+	primary *capturedResponse
+	// ticket is the circuit breaker's permission for a mirror request
+	ticket circuitTicket
+	// onResponse decides whether the proxied response is captured for mirrors and the recording, see processRequest
+	onResponse func(resp *http.Response) bool
+	// attempt counts the tries of a proxied request from 1, canRetry is set unless it is the last one
+	attempt  int
+	canRetry bool
+	// cancel and deadline bound a proxied request, see newAttemptContext
+	cancel   context.CancelCauseFunc
+	deadline *attemptDeadline
 }
 
 func NewProxyController(
@@ -64,166 +114,470 @@ func NewProxyController(
 	cfg *config.Config,
 	logger logging.Logger,
 	metrics metric.MetricService,
-) ProxyController {
-	target, err := url.Parse(cfg.Proxy.TargetURL)
-	if err != nil {
-		logger.Fatalf("invalid target URL: %v", err)
+) (ProxyController, error) {
+	pc := &proxyController{
+		ctx:         ctx,
+		logger:      logger,
+		metrics:     metrics,
+		retryBudget: newRetryBudget(),
 	}
-	var mirror *url.URL
-	if cfg.Proxy.MirrorURL != "" {
-		mirror, err = url.Parse(cfg.Proxy.MirrorURL)
-		if err != nil {
-			logger.Fatalf("invalid mirror URL: %v", err)
-		}
+
+	state, err := newProxyState(ctx, cfg, logger, metrics, nil)
+	if err != nil {
+		return nil, err
 	}
+	pc.state.Store(state)
 
-	pc := &proxyController{
-		ctx:               ctx,
-		cfg:               cfg,
-		logger:            logger,
-		metrics:           metrics,
-		target:            target,
-		mirror:            mirror,
-		proxyActiveConns:  new(int64),
-		mirrorActiveConns: new(int64),
-	}
-
-	transport := &http.Transport{
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 100,
-		DisableKeepAlives:   false,
-		DisableCompression:  true,
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			dialer := &net.Dialer{
-				Timeout: cfg.Proxy.DialTimeout,
-			}
-			return dialer.DialContext(ctx, network, addr)
-		},
+	pc.dispatcher, err = newMirrorDispatcher(ctx, cfg.Proxy.MirrorQueue, logger, metrics, pc.processMirrorJob)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror queue: %w", err)
 	}
 
-	pc.client = &http.Client{
-		Transport: transport,
-		Timeout:   cfg.Proxy.Timeout,
+	pc.recorder, err = newTrafficRecorder(ctx, cfg.Recording, logger, metrics)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recording: %w", err)
 	}
 
-	return pc
+	go pc.runBackendHealthChecks()
+	return pc, nil
 }
 
 func (_this *proxyController) proxyAndMirrorRequest(c *gin.Context) {
 	// Generate or get trace ID
-	traceID := c.GetHeader("X-Trace-ID")
-	if traceID == "" {
-		traceID = uuid.New().String()
+	traceID := headers.TraceID(c.Request.Header)
+
+	// The whole request, mirrors included, uses the config that was current when it arrived
+	state := _this.state.Load()
+	route := state.route(c.Request)
+	if route == nil {
+		_this.rejectUnrouted(c, traceID)
+		return
 	}
+	c.Set(RouteContextKey, route.name)
+	header := state.forwarding.upstreamHeader(c.Request)
 
-	// Read the original request body
-	bodyBytes, err := io.ReadAll(c.Request.Body)
-	if err != nil {
-		_this.logger.Errorw("failed to read request body",
-			"error", err,
-			"trace_id", traceID,
-		)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read request"})
+	// Upgraded connections are neither buffered nor recorded
+	if isUpgradeRequest(c.Request) {
+		_this.proxyUpgrade(c, state, route, header, traceID)
+		return
+	}
+
+	// Decide up front which copies of the request are needed, so the body is only kept in memory when it is used
+	mirrors := _this.selectMirrors(c, state, route, traceID)
+	record := _this.recorder != nil && _this.recorder.selects(c.Request, traceID)
+	if len(mirrors) == 0 && !record {
+		_this.processRequest(c, state, route, header, traceID, nil)
+		return
+	}
+
+	// Stream the request body upstream while keeping a copy for mirrors and the recording
+	body := newBodyCapture(c.Request.Body, c.Request.ContentLength, state.cfg.Proxy.MirrorMaxBodySize)
+	c.Request.Body = body
+
+	// Copies that don't need the primary response are sent as soon as it arrives, a long-lived stream would hold
+	// them back for as long as it lasts. Streams are not captured, so nothing waits for them.
+	waiting, recordWaiting := mirrors, record
+	onResponse := func(resp *http.Response) bool {
+		streaming := isStreamingResponse(resp)
+		bodyBytes, complete := body.bytes()
+		if !complete {
+			// The upstream answered before reading the whole body, the copies are sent once the exchange is over
+			return !streaming && _this.needsPrimary(waiting, recordWaiting)
+		}
+		var ready, later []*mirrorTarget
+		for _, mirror := range waiting {
+			if mirror.comparer != nil && !streaming {
+				later = append(later, mirror)
+			} else {
+				ready = append(ready, mirror)
+			}
+		}
+		recordNow := recordWaiting && (!_this.recorder.includeResponse || streaming)
+		_this.sendCopies(c, state, route, header, traceID, ready, recordNow, bodyBytes, nil)
+		waiting, recordWaiting = later, recordWaiting && !recordNow
+		return _this.needsPrimary(waiting, recordWaiting)
+	}
+	primary := _this.processRequest(c, state, route, header, traceID, onResponse)
+	if len(waiting) == 0 && !recordWaiting {
 		return
 	}
-	_ = c.Request.Body.Close()
 
-	// Restore the request body for downstream middleware/handlers
-	c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	// Mirror workers must not touch the gin context, which is recycled once this handler returns. Mirrors still get
+	// the body when the primary failed before reading it, that is when a shadow matters most.
+	body.readRest()
+	bodyBytes, complete := body.bytes()
+	if !complete {
+		reason := dropBodyIncomplete
+		if body.overflowed() {
+			reason = dropBodyTooLarge
+		}
+		for _, mirror := range waiting {
+			_this.dispatcher.drop(&mirrorJob{
+				mirror:  mirror,
+				route:   route,
+				method:  c.Request.Method,
+				path:    c.Request.URL.Path,
+				traceID: traceID,
+			}, reason)
+		}
+		if recordWaiting {
+			_this.recorder.recordResult(c.Request.Method, route.name, string(reason))
+		}
+		return
+	}
+	_this.sendCopies(c, state, route, header, traceID, waiting, recordWaiting, bodyBytes, primary)
+}
 
-	_this.processRequest(c, proxyRequest, bodyBytes, _this.target, traceID)
-	if _this.mirror != nil {
-		go _this.processRequest(c, mirrorRequest, bodyBytes, _this.mirror, traceID)
+// needsPrimary reports whether the primary response has to be captured for the given copies of a request
+func (_this *proxyController) needsPrimary(mirrors []*mirrorTarget, record bool) bool {
+	needed := record && _this.recorder.includeResponse
+	for _, mirror := range mirrors {
+		needed = needed || mirror.comparer != nil
 	}
+	return needed
 }
 
-func (_this *proxyController) processRequest(
+// sendCopies enqueues the request for the given mirrors and records it. The recording keeps the headers as the
+// client sent them, mirrors get the same ones as the backend.
+func (_this *proxyController) sendCopies(
 	c *gin.Context,
-	reqType requestType,
+	state *proxyState,
+	route *route,
+	header http.Header,
+	traceID string,
+	mirrors []*mirrorTarget,
+	record bool,
 	bodyBytes []byte,
-	targetURL *url.URL,
+	primary *capturedResponse,
+) {
+	if record {
+		_this.recordRequest(c, route, c.Request.Header.Clone(), bodyBytes, traceID, primary)
+	}
+	for _, mirror := range mirrors {
+		_this.dispatcher.enqueue(&mirrorJob{
+			mirror:   mirror,
+			route:    route,
+			method:   c.Request.Method,
+			path:     c.Request.URL.Path,
+			rawQuery: c.Request.URL.RawQuery,
+			header:   header,
+			body:     bodyBytes,
+			traceID:  traceID,
+			primary:  primary,
+			state:    state,
+		})
+	}
+}
+
+// rejectUnrouted answers requests that match no route when there is no default target
+func (_this *proxyController) rejectUnrouted(c *gin.Context, traceID string) {
+	_ = _this.metrics.RecordRequest(
+		_this.ctx,
+		metric.MetricProxy,
+		c.Request.Method,
+		unroutedRouteName,
+		attribute.String("status_class", "4xx"),
+		attribute.Int("status_code", http.StatusNotFound),
+	)
+	_this.logger.Debugw("no route for request",
+		"method", c.Request.Method,
+		"host", c.Request.Host,
+		"path", c.Request.URL.Path,
+		"trace_id", traceID,
+	)
+	c.JSON(http.StatusNotFound, gin.H{"error": "no route"})
+}
+
+// selectMirrors returns the mirrors that should receive a copy of the request
+func (_this *proxyController) selectMirrors(
+	c *gin.Context,
+	state *proxyState,
+	route *route,
 	traceID string,
+) []*mirrorTarget {
+	var selected []*mirrorTarget
+	for _, mirror := range state.mirrors {
+		if !route.allowsMirror(mirror) || !mirror.filter.match(c.Request) || !_this.sampleMirror(c, route, mirror, traceID) {
+			continue
+		}
+		// Skip mirrors whose circuit is open without taking up room in the queue
+		if mirror.breaker != nil && mirror.breaker.open() {
+			_this.dispatcher.drop(&mirrorJob{
+				mirror:  mirror,
+				route:   route,
+				method:  c.Request.Method,
+				path:    c.Request.URL.Path,
+				traceID: traceID,
+			}, dropCircuitOpen)
+			continue
+		}
+		selected = append(selected, mirror)
+	}
+	return selected
+}
+
+func (_this *proxyController) recordRequest(
+	c *gin.Context,
+	route *route,
+	header http.Header,
+	bodyBytes []byte,
+	traceID string,
+	primary *capturedResponse,
 ) {
-	// Create appropriate context based on request type
-	var reqContext context.Context
-	if reqType == mirrorRequest {
-		// For mirror requests, use controller context with timeout.
-		var cancel context.CancelFunc
-		reqContext, cancel = context.WithTimeout(_this.ctx, _this.cfg.Proxy.Timeout)
-		defer cancel()
-	} else {
-		// For proxy requests, use the gin context
-		reqContext = c.Request.Context()
+	if !_this.recorder.includeCredentials {
+		header = config.RedactHeader(header)
+	}
+	rec := &recording.Record{
+		Timestamp: time.Now(),
+		TraceID:   traceID,
+		Route:     route.name,
+		Method:    c.Request.Method,
+		Host:      c.Request.Host,
+		Path:      c.Request.URL.Path,
+		Query:     c.Request.URL.RawQuery,
+		Header:    header,
+		Body:      bodyBytes,
 	}
+	if _this.recorder.includeResponse && primary != nil {
+		rec.Response = &recording.Response{
+			StatusCode: primary.statusCode,
+			Header:     primary.header,
+			Body:       primary.body,
+			Duration:   primary.duration,
+		}
+		if !_this.recorder.includeCredentials {
+			rec.Response.Header = config.RedactHeader(primary.header)
+		}
+	}
+	_this.recorder.record(rec)
+}
 
-	// Instead of cloning, create a new request.
-	targetPath := c.Request.URL.Path
-	if c.Request.URL.RawQuery != "" {
-		targetPath += "?" + c.Request.URL.RawQuery
+func (_this *proxyController) sampleMirror(c *gin.Context, route *route, mirror *mirrorTarget, traceID string) bool {
+	sampled, mode := mirror.sampler.sample(c.Request, traceID)
+
+	decision := "skipped"
+	if sampled {
+		decision = "sampled"
 	}
+	_ = _this.metrics.RecordRequest(
+		_this.ctx,
+		metric.MetricMirrorSampling,
+		c.Request.Method,
+		route.name,
+		attribute.String("mirror", mirror.name),
+		attribute.String("decision", decision),
+		attribute.String("mode", string(mode)),
+	)
+	return sampled
+}
 
-	req, err := http.NewRequestWithContext(
+// processRequest proxies the request, returning the response when it was captured in full. onResponse, when set, is
+// called once the response for the client arrived and reports whether its body must be captured.
+func (_this *proxyController) processRequest(
+	c *gin.Context,
+	state *proxyState,
+	route *route,
+	header http.Header,
+	traceID string,
+	onResponse func(resp *http.Response) bool,
+) *capturedResponse {
+	// Retries resend the body, so it has to be kept in memory. Other requests stream it.
+	policy := state.retry
+	_this.retryBudget.recordRequest(policy)
+	var bodyBytes []byte
+	retryable := policy.allows(c.Request)
+	if retryable {
+		bodyBytes, retryable = bufferRequestBody(c.Request, state.cfg.Proxy.MirrorMaxBodySize)
+	}
+
+	var tried []*backend
+	for attempt := 1; ; attempt++ {
+		backend := route.pool.pick(c.Request, traceID, tried)
+		tried = append(tried, backend)
+
+		body, contentLength := io.Reader(c.Request.Body), c.Request.ContentLength
+		if retryable {
+			body, contentLength = bytes.NewReader(bodyBytes), int64(len(bodyBytes))
+		}
+
+		// For proxy requests, derive the context from the gin one so requests stop when the client goes away
+		attemptCtx, cancel, deadline := newAttemptContext(c.Request.Context(), route.timeout)
+		req, err := newUpstreamRequest(
+			attemptCtx,
+			c.Request.Method,
+			backend.url,
+			route.rewritePath(c.Request.URL.Path),
+			c.Request.URL.RawQuery,
+			header,
+			body,
+			contentLength,
+			traceID,
+		)
+		if err != nil {
+			deadline.stop()
+			cancel(nil)
+			_this.logger.Errorw(
+				fmt.Sprintf("failed to create %s request", proxyRequest),
+				"error", err,
+				"trace_id", traceID,
+			)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
+			return nil
+		}
+		req.Host = route.upstreamHost(c.Request)
+
+		primary, retry := _this.sendRequest(requestContext{
+			reqType:    proxyRequest,
+			state:      state,
+			route:      route,
+			backend:    backend,
+			ginContext: c,
+			request:    req,
+			startTime:  time.Now(),
+			targetURL:  backend.url,
+			traceID:    traceID,
+			onResponse: onResponse,
+			attempt:    attempt,
+			canRetry:   retryable && attempt < policy.maxAttempts,
+			cancel:     cancel,
+			deadline:   deadline,
+		})
+		deadline.stop()
+		cancel(nil)
+		if !retry {
+			return primary
+		}
+		if !_this.waitForRetry(c.Request.Context(), policy, attempt) {
+			return nil
+		}
+	}
+}
+
+func (_this *proxyController) processMirrorJob(job *mirrorJob) {
+	var ticket circuitTicket
+	if job.mirror.breaker != nil {
+		var allowed bool
+		if ticket, allowed = job.mirror.breaker.allow(); !allowed {
+			_this.dispatcher.drop(job, dropCircuitOpen)
+			return
+		}
+	}
+
+	// For mirror requests, use controller context with the mirror's timeout, starting once the job is dequeued
+	reqContext, cancel := context.WithTimeout(_this.ctx, job.mirror.timeout)
+	defer cancel()
+
+	req, err := newUpstreamRequest(
 		reqContext,
-		c.Request.Method,
-		targetURL.String()+targetPath,
-		bytes.NewBuffer(bodyBytes),
+		job.method,
+		job.mirror.url,
+		job.path,
+		job.rawQuery,
+		job.header,
+		bytes.NewReader(job.body),
+		int64(len(job.body)),
+		job.traceID,
 	)
 	if err != nil {
+		if job.mirror.breaker != nil {
+			job.mirror.breaker.release(ticket)
+		}
 		_this.logger.Errorw(
-			fmt.Sprintf("failed to create %s request", reqType),
+			fmt.Sprintf("failed to create %s request", mirrorRequest),
 			"error", err,
-			"trace_id", traceID,
+			"mirror", job.mirror.name,
+			"trace_id", job.traceID,
 		)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
 		return
 	}
+	job.mirror.transform.apply(req)
 
-	// Copy headers from original request
-	for k, vv := range c.Request.Header {
-		req.Header[k] = vv
+	_this.sendRequest(requestContext{
+		reqType:   mirrorRequest,
+		state:     job.state,
+		route:     job.route,
+		mirror:    job.mirror,
+		request:   req,
+		bodyBytes: job.body,
+		startTime: time.Now(),
+		targetURL: job.mirror.url,
+		traceID:   job.traceID,
+		primary:   job.primary,
+		ticket:    ticket,
+	})
+}
+
+func newUpstreamRequest(
+	ctx context.Context,
+	method string,
+	targetURL *url.URL,
+	path string,
+	rawQuery string,
+	header http.Header,
+	body io.Reader,
+	contentLength int64,
+	traceID string,
+) (*http.Request, error) {
+	// The transport only treats a request as bodiless with http.NoBody
+	if contentLength == 0 {
+		body = http.NoBody
 	}
-	req.Header.Set("X-Trace-ID", traceID)
 
-	if len(bodyBytes) > 0 {
-		req.ContentLength = int64(len(bodyBytes))
+	// Instead of cloning, create a new request.
+	targetPath := path
+	if rawQuery != "" {
+		targetPath += "?" + rawQuery
 	}
 
-	_this.sendRequest(requestContext{
-		reqType:    reqType,
-		ginContext: c,
-		request:    req,
-		bodyBytes:  bodyBytes,
-		startTime:  time.Now(),
-		targetURL:  targetURL,
-		traceID:    traceID,
-	})
+	req, err := http.NewRequestWithContext(
+		ctx,
+		method,
+		targetURL.String()+targetPath,
+		body,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy headers from original request
+	headers.Copy(req.Header, header)
+	req.Header.Set(headers.TraceIDHeader, traceID)
+
+	req.ContentLength = contentLength
+	return req, nil
 }
 
-func (_this *proxyController) sendRequest(reqCtx requestContext) {
+// sendRequest sends the request upstream. Proxied responses are written to the client and returned so mirror
+// responses can be compared against them, unless the attempt failed and should be retried.
+func (_this *proxyController) sendRequest(reqCtx requestContext) (*capturedResponse, bool) {
 	req := reqCtx.request
 	reqType := reqCtx.reqType
 	startTime := time.Now()
 
-	// Set metric name based on request type
+	// Set metric name, client and attributes based on request type
 	metricName := metric.MetricProxy
-	connsCounter := _this.proxyActiveConns
+	client := reqCtx.route.client
+	var metricAttrs []attribute.KeyValue
 	if reqType == mirrorRequest {
 		metricName = metric.MetricMirror
-		connsCounter = _this.mirrorActiveConns
+		client = reqCtx.mirror.client
+		metricAttrs = append(metricAttrs, attribute.String("mirror", reqCtx.mirror.name))
+	} else {
+		metricAttrs = append(metricAttrs, attribute.String("backend", reqCtx.backend.name))
 	}
 
 	// Track connections
+	connsCounter := _this.activeConnections(reqCtx)
 	atomic.AddInt64(connsCounter, 1)
-	_this.recordActiveConnections(reqType)
+	_this.recordActiveConnections(reqCtx)
 	defer func() {
 		atomic.AddInt64(connsCounter, -1)
-		_this.recordActiveConnections(reqType)
+		_this.recordActiveConnections(reqCtx)
 	}()
 
 	// Always record metrics and log response
 	var resp *http.Response
 	var err error
-	var respBody []byte
 	defer func() {
 		statusCode := http.StatusBadGateway // Default error status
 		statusClass := "5xx"
@@ -234,23 +588,35 @@ func (_this *proxyController) sendRequest(reqCtx requestContext) {
 			statusClass = fmt.Sprintf("%dxx", resp.StatusCode/100)
 		}
 
+		// Feed the mirror's circuit breaker and the backend's outlier detection, treating server errors as failures
+		success := err == nil && statusCode < http.StatusInternalServerError
+		if reqType == mirrorRequest && reqCtx.mirror.breaker != nil {
+			reqCtx.mirror.breaker.record(reqCtx.ticket, success)
+		}
+		// Requests the client gave up on say nothing about the backend
+		if reqType == proxyRequest && !clientGone(reqCtx) {
+			_this.recordBackendResult(reqCtx, success)
+		}
+
 		// Record all metrics
+		attrs := append([]attribute.KeyValue{
+			attribute.String("status_class", statusClass),
+			attribute.Int("status_code", statusCode),
+		}, metricAttrs...)
 		_ = _this.metrics.RecordRequest(
 			_this.ctx,
 			metricName,
 			req.Method,
-			req.URL.Path,
-			attribute.String("status_class", statusClass),
-			attribute.Int("status_code", statusCode),
+			reqCtx.route.name,
+			attrs...,
 		)
 		_ = _this.metrics.RecordDuration(
 			_this.ctx,
 			metricName,
 			req.Method,
-			req.URL.Path,
+			reqCtx.route.name,
 			latency,
-			attribute.String("status_class", statusClass),
-			attribute.Int("status_code", statusCode),
+			attrs...,
 		)
 
 		// Log response or error
@@ -285,54 +651,242 @@ func (_this *proxyController) sendRequest(reqCtx requestContext) {
 	)
 
 	// Make the request
-	resp, err = _this.client.Do(req)
+	resp, err = client.Do(req)
+	err = upstreamError(req.Context(), err)
+
+	// Nothing was written to the client yet, so a failed attempt can still be retried
+	if reqCtx.canRetry && _this.shouldRetry(reqCtx, resp, err) {
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return nil, true
+	}
+
 	if err != nil {
 		if reqType == proxyRequest {
 			reqCtx.ginContext.JSON(http.StatusBadGateway, gin.H{"error": "proxy error"})
 		}
-		return
+		return nil, false
 	}
 	defer resp.Body.Close()
 
-	// For mirror requests, we're done here
+	// For mirror requests, we're done here unless the response needs to be compared
 	if reqType == mirrorRequest {
-		return
+		if reqCtx.mirror.comparer != nil && reqCtx.primary != nil {
+			_this.compareResponses(reqCtx, resp)
+		}
+		return nil, false
 	}
 
-	respBody, err = io.ReadAll(resp.Body)
+	captureResponse := reqCtx.onResponse != nil && reqCtx.onResponse(resp)
+	return _this.streamResponse(reqCtx, resp, startTime, captureResponse), false
+}
+
+// streamResponse copies the upstream response to the client as it arrives
+func (_this *proxyController) streamResponse(
+	reqCtx requestContext,
+	resp *http.Response,
+	startTime time.Time,
+	captureResponse bool,
+) *capturedResponse {
+	c := reqCtx.ginContext
+	headers.RemoveHopByHop(resp.Header)
+	// Every value is kept, c.Header would only keep the last Set-Cookie, Vary or Link
+	headers.Copy(c.Writer.Header(), resp.Header)
+	c.Header(headers.ProxiedByHeader, config.ServiceName)
+	c.Header(headers.TraceIDHeader, reqCtx.traceID)
+	if resp.ContentLength >= 0 {
+		c.Header("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	c.Status(resp.StatusCode)
+	c.Writer.WriteHeaderNow()
+
+	// HEAD responses must not carry a body, the upstream one is still drained so the capture completes
+	streaming := isStreamingResponse(resp) && reqCtx.request.Method != http.MethodHead
+	if streaming {
+		// Streams may stay open for as long as the backend produces data, they are only cut when they stall
+		reqCtx.deadline.stop()
+		c.Writer.Flush()
+	}
+
+	var body io.ReadCloser = resp.Body
+	var capture *bodyCapture
+	if captureResponse {
+		capture = newBodyCapture(resp.Body, resp.ContentLength, reqCtx.state.cfg.Proxy.MirrorMaxBodySize)
+		body = capture
+	}
+
+	var dst io.Writer = c.Writer
+	if reqCtx.request.Method == http.MethodHead {
+		dst = io.Discard
+	}
+
+	// The status is already sent, so the only way left to tell the client the response is incomplete is to abort
+	// the connection. Ending the response normally would pass the truncated body off as complete.
+	var err error
+	if streaming {
+		err = copyStreaming(reqCtx, c.Writer, body)
+	} else if _, err = io.Copy(dst, body); err != nil {
+		err = upstreamError(reqCtx.request.Context(), err)
+	}
 	if err != nil {
-		reqCtx.ginContext.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read response"})
+		_this.logger.Warnw("failed to stream response",
+			"error", err,
+			"method", reqCtx.request.Method,
+			"url", reqCtx.request.URL.String(),
+			"trace_id", reqCtx.traceID,
+		)
+		panic(http.ErrAbortHandler)
+	}
+
+	if capture == nil {
+		return nil
+	}
+	respBody, complete := capture.bytes()
+	if !complete {
+		return nil
+	}
+	return &capturedResponse{
+		statusCode: resp.StatusCode,
+		header:     resp.Header,
+		body:       respBody,
+		duration:   time.Since(startTime),
+	}
+}
+
+func (_this *proxyController) compareResponses(reqCtx requestContext, resp *http.Response) {
+	req := reqCtx.request
+	mirror := reqCtx.mirror
+
+	// The mirror response is bounded like the primary one, a misbehaving mirror must not exhaust the workers' memory
+	limit := reqCtx.state.cfg.Proxy.MirrorMaxBodySize
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		_this.logger.Errorw("failed to read mirror response for comparison",
+			"error", err,
+			"mirror", mirror.name,
+			"trace_id", reqCtx.traceID,
+		)
+		return
+	}
+	if int64(len(respBody)) > limit {
+		_ = _this.metrics.RecordRequest(
+			_this.ctx,
+			metric.MetricMirrorCompare,
+			req.Method,
+			reqCtx.route.name,
+			attribute.String("mirror", mirror.name),
+			attribute.String("result", string(dropBodyTooLarge)),
+		)
+		return
+	}
+
+	diffs := mirror.comparer.diff(reqCtx.primary, &capturedResponse{
+		statusCode: resp.StatusCode,
+		header:     resp.Header,
+		body:       respBody,
+	})
+
+	result := "match"
+	if len(diffs) > 0 {
+		result = "mismatch"
+	}
+	_ = _this.metrics.RecordRequest(
+		_this.ctx,
+		metric.MetricMirrorCompare,
+		req.Method,
+		reqCtx.route.name,
+		attribute.String("mirror", mirror.name),
+		attribute.String("result", result),
+	)
+	if len(diffs) == 0 {
 		return
 	}
 
-	for k, vv := range resp.Header {
-		for _, v := range vv {
-			reqCtx.ginContext.Header(k, v)
+	// Count each kind of mismatch once per response pair
+	kinds := make(map[diffKind]bool)
+	for _, diff := range diffs {
+		if kinds[diff.Kind] {
+			continue
 		}
+		kinds[diff.Kind] = true
+		_ = _this.metrics.RecordRequest(
+			_this.ctx,
+			metric.MetricMirrorMismatch,
+			req.Method,
+			reqCtx.route.name,
+			attribute.String("mirror", mirror.name),
+			attribute.String("kind", string(diff.Kind)),
+		)
 	}
-	reqCtx.ginContext.Header("X-Proxied-By", config.ServiceName)
-	reqCtx.ginContext.Header("X-Trace-ID", reqCtx.traceID)
-	reqCtx.ginContext.Data(resp.StatusCode, resp.Header.Get("Content-Type"), respBody)
+
+	_this.logger.Warnw("mirror response mismatch",
+		"mirror", mirror.name,
+		"method", req.Method,
+		"url", req.URL.String(),
+		"primary_status", reqCtx.primary.statusCode,
+		"mirror_status", resp.StatusCode,
+		"diffs", diffs,
+		"trace_id", reqCtx.traceID,
+	)
 }
 
-func (_this *proxyController) recordActiveConnections(reqType requestType) {
-	metricName := metric.MetricProxyConnections
-	connsCounter := _this.proxyActiveConns
+// activeConnections returns the counter of the mirror or backend the request is sent to
+func (_this *proxyController) activeConnections(reqCtx requestContext) *int64 {
+	if reqCtx.reqType == mirrorRequest {
+		return reqCtx.mirror.activeConns
+	}
+	return reqCtx.backend.activeConns
+}
 
-	if reqType == mirrorRequest {
-		metricName = metric.MetricMirrorConnections
-		connsCounter = _this.mirrorActiveConns
+func (_this *proxyController) recordActiveConnections(reqCtx requestContext) {
+	if reqCtx.reqType == mirrorRequest {
+		_ = _this.metrics.RecordGauge(
+			_this.ctx,
+			metric.MetricMirrorConnections,
+			float64(atomic.LoadInt64(reqCtx.mirror.activeConns)),
+			attribute.String("mirror", reqCtx.mirror.name),
+		)
+		return
 	}
 
 	_ = _this.metrics.RecordGauge(
 		_this.ctx,
-		metricName,
-		float64(atomic.LoadInt64(connsCounter)),
+		metric.MetricProxyConnections,
+		float64(atomic.LoadInt64(reqCtx.backend.activeConns)),
+		attribute.String("backend", reqCtx.backend.name),
 	)
 }
 
+func (_this *proxyController) UpdateConfig(cfg *config.Config) error {
+	previous := _this.state.Load()
+	state, err := newProxyState(_this.ctx, cfg, _this.logger, _this.metrics, previous)
+	if err != nil {
+		return err
+	}
+	_this.state.Store(state)
+
+	// Requests still using the previous transport keep their connections, only idle ones are released
+	previous.closeIdleConnections()
+	return nil
+}
+
+func (_this *proxyController) CurrentState() *proxyState {
+	return _this.state.Load()
+}
+
+// Close flushes the traffic recording. It must only be called once the servers stopped handling requests.
+func (_this *proxyController) Close() {
+	if _this.recorder != nil {
+		_this.recorder.close()
+	}
+}
+
 func (_this *proxyController) ProxyGetRequest(c *gin.Context)     { _this.proxyAndMirrorRequest(c) }
 func (_this *proxyController) ProxyPostRequest(c *gin.Context)    { _this.proxyAndMirrorRequest(c) }
 func (_this *proxyController) ProxyPutRequest(c *gin.Context)     { _this.proxyAndMirrorRequest(c) }
 func (_this *proxyController) ProxyDeleteRequest(c *gin.Context)  { _this.proxyAndMirrorRequest(c) }
 func (_this *proxyController) ProxyOptionsRequest(c *gin.Context) { _this.proxyAndMirrorRequest(c) }
+func (_this *proxyController) ProxyPatchRequest(c *gin.Context)   { _this.proxyAndMirrorRequest(c) }
+func (_this *proxyController) ProxyHeadRequest(c *gin.Context)    { _this.proxyAndMirrorRequest(c) }
+func (_this *proxyController) ProxyTraceRequest(c *gin.Context)   { _this.proxyAndMirrorRequest(c) }
@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+
+	"github.com/3box/go-proxy/common/config"
+	"github.com/3box/go-proxy/common/logging"
+	"github.com/3box/go-proxy/common/metric"
+)
+
+// proxyState holds everything derived from the reloadable part of the config. Requests load it once and keep using
+// it until they complete, so a reload never affects requests in flight.
+type proxyState struct {
+	cfg *config.Config
+	// transport is shared by the mirrors and usually the default route, other routes have their own
+	transport *http.Transport
+	routes    []*route
+	// backends are shared by the routes, keyed by URL
+	backends      map[string]*backend
+	backendHealth *backendHealthSettings
+	retry         *retryPolicy
+	forwarding    *forwardingPolicy
+	// defaultRoute is nil without Proxy.TargetURLs
+	defaultRoute *route
+	mirrors      []*mirrorTarget
+}
+
+// newProxyState builds the state for a config. Mirror connection counters are carried over from the previous state,
+// as are circuit breakers whose settings did not change.
+func newProxyState(
+	ctx context.Context,
+	cfg *config.Config,
+	logger logging.Logger,
+	metrics metric.MetricService,
+	previous *proxyState,
+) (*proxyState, error) {
+	state := &proxyState{
+		cfg:       cfg,
+		transport: newTransport(cfg.Proxy.DialTimeout, config.UpstreamTLSConfig{}),
+		backends:  make(map[string]*backend),
+		// Health settings apply to the backends as soon as the state is swapped in
+		backendHealth: newBackendHealthSettings(cfg),
+		retry:         newRetryPolicy(cfg.Proxy.Retry),
+	}
+
+	forwarding, err := newForwardingPolicy(cfg.Proxy.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	state.forwarding = forwarding
+
+	backendURLs := append([]string(nil), cfg.Proxy.TargetURLs...)
+	for _, routeCfg := range cfg.Proxy.Routes {
+		backendURLs = append(backendURLs, routeCfg.TargetURLs...)
+	}
+	for _, rawURL := range backendURLs {
+		if state.backends[rawURL] != nil {
+			continue
+		}
+		var prev *backend
+		if previous != nil {
+			prev = previous.backends[rawURL]
+		}
+		b, err := newBackend(rawURL, prev)
+		if err != nil {
+			return nil, err
+		}
+		state.backends[rawURL] = b
+	}
+
+	for _, routeCfg := range cfg.Proxy.Routes {
+		r, err := newRoute(routeCfg, state.backends)
+		if err != nil {
+			return nil, err
+		}
+		state.routes = append(state.routes, r)
+	}
+	if len(cfg.Proxy.TargetURLs) > 0 {
+		defaultRoute, err := newDefaultRoute(cfg.Proxy, state.transport, state.backends)
+		if err != nil {
+			return nil, err
+		}
+		state.defaultRoute = defaultRoute
+	}
+
+	previousMirrors := make(map[string]*mirrorTarget)
+	if previous != nil {
+		for _, mirror := range previous.mirrors {
+			previousMirrors[mirror.name] = mirror
+		}
+	}
+
+	// Mirrors share the transport but each has its own timeout
+	for _, mirrorCfg := range cfg.Proxy.Mirrors {
+		mirrorURL, err := url.Parse(mirrorCfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL for mirror %s: %w", mirrorCfg.Name, err)
+		}
+		mirrorFilter, err := newRequestFilter(mirrorCfg.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rules for mirror %s: %w", mirrorCfg.Name, err)
+		}
+		mirrorSampler, err := newSampler(mirrorCfg.SampleRate, mirrorCfg.SampleKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sampling for mirror %s: %w", mirrorCfg.Name, err)
+		}
+		mirrorTransform, err := newRequestTransform(mirrorCfg.Transform)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transform for mirror %s: %w", mirrorCfg.Name, err)
+		}
+
+		mirror := &mirrorTarget{
+			name:    mirrorCfg.Name,
+			cfg:     mirrorCfg,
+			url:     mirrorURL,
+			timeout: mirrorCfg.Timeout,
+			client: &http.Client{
+				Transport: state.transport,
+				Timeout:   mirrorCfg.Timeout,
+			},
+			filter:      mirrorFilter,
+			sampler:     mirrorSampler,
+			transform:   mirrorTransform,
+			comparer:    newResponseComparer(mirrorCfg.Compare),
+			activeConns: new(int64),
+		}
+		if prev, found := previousMirrors[mirrorCfg.Name]; found {
+			mirror.activeConns = prev.activeConns
+			if reflect.DeepEqual(prev.cfg.CircuitBreaker, mirrorCfg.CircuitBreaker) {
+				mirror.breaker = prev.breaker
+			}
+		}
+		if mirror.breaker == nil {
+			mirror.breaker = newCircuitBreaker(ctx, mirrorCfg.Name, mirrorCfg.CircuitBreaker, logger, metrics)
+		}
+		state.mirrors = append(state.mirrors, mirror)
+	}
+
+	return state, nil
+}
+
+// route returns the first route matching the request, nil when none does
+func (_this *proxyState) route(r *http.Request) *route {
+	for _, candidate := range _this.routes {
+		if candidate.match(r) {
+			return candidate
+		}
+	}
+	return _this.defaultRoute
+}
+
+// allRoutes returns the routes in the order requests are matched against them, the default route last
+func (_this *proxyState) allRoutes() []*route {
+	routes := _this.routes
+	if _this.defaultRoute != nil {
+		routes = append(routes[:len(routes):len(routes)], _this.defaultRoute)
+	}
+	return routes
+}
+
+// closeIdleConnections releases the idle connections of every transport, requests in flight keep theirs
+func (_this *proxyState) closeIdleConnections() {
+	_this.transport.CloseIdleConnections()
+	for _, r := range _this.allRoutes() {
+		r.transport.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/3box/go-proxy/common/config"
+)
+
+// requestMatcher checks a request against the conditions of a single rule. All configured conditions must match.
+type requestMatcher struct {
+	hosts      []string
+	methods    map[string]bool
+	pathPrefix string
+	paths      []string
+	pathRegex  *regexp.Regexp
+	headers    map[string]string
+}
+
+func newRequestMatcher(cfg config.RequestMatchConfig) (*requestMatcher, error) {
+	matcher := &requestMatcher{pathPrefix: cfg.PathPrefix}
+	for _, pattern := range cfg.Hosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+		}
+		matcher.hosts = append(matcher.hosts, strings.ToLower(pattern))
+	}
+	if len(cfg.Methods) > 0 {
+		matcher.methods = make(map[string]bool, len(cfg.Methods))
+		for _, method := range cfg.Methods {
+			matcher.methods[strings.ToUpper(method)] = true
+		}
+	}
+	for _, pattern := range cfg.Paths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+		}
+		matcher.paths = append(matcher.paths, pattern)
+	}
+	if cfg.PathRegex != "" {
+		pathRegex, err := regexp.Compile(cfg.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path regex %q: %w", cfg.PathRegex, err)
+		}
+		matcher.pathRegex = pathRegex
+	}
+	if len(cfg.Headers) > 0 {
+		matcher.headers = make(map[string]string, len(cfg.Headers))
+		for name, value := range cfg.Headers {
+			matcher.headers[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+	return matcher, nil
+}
+
+func (_this *requestMatcher) match(r *http.Request) bool {
+	if len(_this.hosts) > 0 && !matchAny(_this.hosts, requestHost(r)) {
+		return false
+	}
+	if _this.methods != nil && !_this.methods[r.Method] {
+		return false
+	}
+	if !strings.HasPrefix(r.URL.Path, _this.pathPrefix) {
+		return false
+	}
+	if len(_this.paths) > 0 && !matchAny(_this.paths, r.URL.Path) {
+		return false
+	}
+	if _this.pathRegex != nil && !_this.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	for name, value := range _this.headers {
+		values, found := r.Header[name]
+		if !found {
+			return false
+		}
+		// An empty value only requires the header to be present
+		if value != "" && !contains(values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestFilter matches a request when any of its rules do, or when it has no rules at all
+type requestFilter []*requestMatcher
+
+func newRequestFilter(rules []config.RequestMatchConfig) (requestFilter, error) {
+	filter := make(requestFilter, 0, len(rules))
+	for i, rule := range rules {
+		matcher, err := newRequestMatcher(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		filter = append(filter, matcher)
+	}
+	return filter, nil
+}
+
+func (_this requestFilter) match(r *http.Request) bool {
+	if len(_this) == 0 {
+		return true
+	}
+	for _, matcher := range _this {
+		if matcher.match(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether the value matches any of the path.Match patterns
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHost returns the lowercased host the client asked for, without its port
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/3box/go-proxy/common/config"
+)
+
+// requestTransform rewrites the mirrored copy of a request. Headers are renamed, then removed, then set.
+type requestTransform struct {
+	setHeaders    map[string]string
+	removeHeaders []string
+	renameHeaders map[string]string
+	pathFrom      string
+	pathTo        string
+	host          string
+	setQuery      [][2]string
+	removeQuery   []string
+}
+
+func newRequestTransform(cfg config.TransformConfig) (*requestTransform, error) {
+	if cfg.PathPrefix.From == "" && cfg.PathPrefix.To != "" {
+		return nil, fmt.Errorf("path prefix rewrite to %q is missing the prefix to replace", cfg.PathPrefix.To)
+	}
+
+	transform := &requestTransform{
+		setHeaders:    make(map[string]string, len(cfg.SetHeaders)),
+		renameHeaders: make(map[string]string, len(cfg.RenameHeaders)),
+		pathFrom:      cfg.PathPrefix.From,
+		pathTo:        cfg.PathPrefix.To,
+		host:          cfg.Host,
+		removeQuery:   cfg.RemoveQuery,
+	}
+	for _, pair := range cfg.SetQuery {
+		name, value, found := strings.Cut(pair, "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("query parameter %q is not of the form name=value", pair)
+		}
+		transform.setQuery = append(transform.setQuery, [2]string{name, value})
+	}
+	for name, value := range cfg.SetHeaders {
+		transform.setHeaders[http.CanonicalHeaderKey(name)] = value
+	}
+	for _, name := range cfg.RemoveHeaders {
+		transform.removeHeaders = append(transform.removeHeaders, http.CanonicalHeaderKey(name))
+	}
+	for from, to := range cfg.RenameHeaders {
+		transform.renameHeaders[http.CanonicalHeaderKey(from)] = http.CanonicalHeaderKey(to)
+	}
+	return transform, nil
+}
+
+func (_this *requestTransform) apply(req *http.Request) {
+	for from, to := range _this.renameHeaders {
+		if values, found := req.Header[from]; found {
+			delete(req.Header, from)
+			req.Header[to] = values
+		}
+	}
+	for _, name := range _this.removeHeaders {
+		req.Header.Del(name)
+	}
+	for name, value := range _this.setHeaders {
+		req.Header.Set(name, value)
+	}
+
+	if _this.pathFrom != "" && strings.HasPrefix(req.URL.Path, _this.pathFrom) {
+		req.URL.Path = _this.pathTo + strings.TrimPrefix(req.URL.Path, _this.pathFrom)
+		req.URL.RawPath = ""
+	}
+
+	if len(_this.setQuery) > 0 || len(_this.removeQuery) > 0 {
+		query := req.URL.Query()
+		for _, name := range _this.removeQuery {
+			query.Del(name)
+		}
+		for _, param := range _this.setQuery {
+			query.Set(param[0], param[1])
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+
+	if _this.host != "" {
+		req.Host = _this.host
+	}
+}
@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3box/go-proxy/common/config"
+)
+
+// Limit the number of differences reported for a single response pair
+const maxResponseDiffs = 20
+
+type diffKind string
+
+const (
+	diffStatus diffKind = "status"
+	diffHeader diffKind = "header"
+	diffBody   diffKind = "body"
+)
+
+// capturedResponse is a fully read upstream response kept around for comparison
+type capturedResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	duration   time.Duration
+}
+
+type responseDiff struct {
+	Kind    diffKind    `json:"kind"`
+	Path    string      `json:"path,omitempty"`
+	Primary interface{} `json:"primary"`
+	Mirror  interface{} `json:"mirror"`
+}
+
+// responseComparer diffs a mirror response against the primary response
+type responseComparer struct {
+	headers      []string
+	ignoredPaths [][]string
+}
+
+func newResponseComparer(cfg config.CompareConfig) *responseComparer {
+	if !cfg.Enabled {
+		return nil
+	}
+	comparer := &responseComparer{}
+	for _, header := range cfg.Headers {
+		comparer.headers = append(comparer.headers, http.CanonicalHeaderKey(header))
+	}
+	for _, path := range cfg.IgnoredPaths {
+		comparer.ignoredPaths = append(comparer.ignoredPaths, strings.Split(path, "."))
+	}
+	return comparer
+}
+
+func (_this *responseComparer) diff(primary, mirror *capturedResponse) []responseDiff {
+	var diffs []responseDiff
+	if primary.statusCode != mirror.statusCode {
+		diffs = append(diffs, responseDiff{Kind: diffStatus, Primary: primary.statusCode, Mirror: mirror.statusCode})
+	}
+	for _, header := range _this.headers {
+		primaryValue := strings.Join(primary.header.Values(header), ",")
+		mirrorValue := strings.Join(mirror.header.Values(header), ",")
+		if primaryValue != mirrorValue {
+			diffs = append(diffs, responseDiff{Kind: diffHeader, Path: header, Primary: primaryValue, Mirror: mirrorValue})
+		}
+	}
+
+	// Compare bodies structurally when both are JSON, byte for byte otherwise
+	primaryJSON, primaryErr := decodeJSON(primary.body)
+	mirrorJSON, mirrorErr := decodeJSON(mirror.body)
+	if primaryErr == nil && mirrorErr == nil {
+		diffs = _this.diffJSON(diffs, nil, primaryJSON, mirrorJSON)
+	} else if !bytes.Equal(primary.body, mirror.body) {
+		diffs = append(diffs, responseDiff{Kind: diffBody, Primary: len(primary.body), Mirror: len(mirror.body)})
+	}
+
+	if len(diffs) > maxResponseDiffs {
+		diffs = diffs[:maxResponseDiffs]
+	}
+	return diffs
+}
+
+func (_this *responseComparer) diffJSON(diffs []responseDiff, path []string, primary, mirror interface{}) []responseDiff {
+	if len(diffs) >= maxResponseDiffs || _this.ignored(path) {
+		return diffs
+	}
+
+	switch primaryValue := primary.(type) {
+	case map[string]interface{}:
+		if mirrorValue, ok := mirror.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(primaryValue)+len(mirrorValue))
+			for k := range primaryValue {
+				keys = append(keys, k)
+			}
+			for k := range mirrorValue {
+				if _, found := primaryValue[k]; !found {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				diffs = _this.diffJSON(diffs, append(path, k), primaryValue[k], mirrorValue[k])
+			}
+			return diffs
+		}
+	case []interface{}:
+		if mirrorValue, ok := mirror.([]interface{}); ok {
+			for i := 0; i < max(len(primaryValue), len(mirrorValue)); i++ {
+				var p, m interface{}
+				if i < len(primaryValue) {
+					p = primaryValue[i]
+				}
+				if i < len(mirrorValue) {
+					m = mirrorValue[i]
+				}
+				diffs = _this.diffJSON(diffs, append(path, strconv.Itoa(i)), p, m)
+			}
+			return diffs
+		}
+	}
+
+	if !jsonEqual(primary, mirror) {
+		diffs = append(diffs, responseDiff{Kind: diffBody, Path: strings.Join(path, "."), Primary: primary, Mirror: mirror})
+	}
+	return diffs
+}
+
+// decodeJSON keeps numbers as json.Number, as float64 would make distinct 64-bit IDs compare equal
+func decodeJSON(body []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return value, nil
+}
+
+// jsonEqual compares scalar JSON values, numbers by value so that e.g. 1.0 and 1 are equal
+func jsonEqual(primary, mirror interface{}) bool {
+	primaryNumber, primaryOK := primary.(json.Number)
+	mirrorNumber, mirrorOK := mirror.(json.Number)
+	if primaryOK && mirrorOK {
+		// The precision covers 64-bit integers and more, without the cost of exact values for huge exponents
+		p, _, pErr := big.ParseFloat(primaryNumber.String(), 10, 256, big.ToNearestEven)
+		m, _, mErr := big.ParseFloat(mirrorNumber.String(), 10, 256, big.ToNearestEven)
+		if pErr == nil && mErr == nil {
+			return p.Cmp(m) == 0
+		}
+	}
+	return reflect.DeepEqual(primary, mirror)
+}
+
+// ignored reports whether a JSON path matches one of the ignored paths, where "*" matches any single key or index
+func (_this *responseComparer) ignored(path []string) bool {
+	for _, ignoredPath := range _this.ignoredPaths {
+		if len(ignoredPath) != len(path) {
+			continue
+		}
+		matched := true
+		for i, segment := range ignoredPath {
+			if segment != "*" && segment != path[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
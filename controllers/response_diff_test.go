@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/3box/go-proxy/common/config"
+)
+
+func TestResponseComparerIgnored(t *testing.T) {
+	comparer := newResponseComparer(config.CompareConfig{
+		Enabled:      true,
+		IgnoredPaths: []string{"timestamp", "items.*.id", "meta.*"},
+	})
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "timestamp", want: true},
+		{path: "items.0.id", want: true},
+		{path: "items.12.id", want: true},
+		{path: "items.0.name", want: false},
+		{path: "items.0", want: false},
+		{path: "meta.version", want: true},
+		{path: "meta.version.major", want: false},
+		{path: "meta", want: false},
+		{path: "other", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := comparer.ignored(strings.Split(tt.path, ".")); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseComparerDiff(t *testing.T) {
+	comparer := newResponseComparer(config.CompareConfig{
+		Enabled:      true,
+		Headers:      []string{"content-type"},
+		IgnoredPaths: []string{"timestamp"},
+	})
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+
+	tests := []struct {
+		name    string
+		primary *capturedResponse
+		mirror  *capturedResponse
+		want    []string
+	}{
+		{
+			name:    "equal",
+			primary: &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`{"a":1}`)},
+			mirror:  &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`{"a":1}`)},
+		},
+		{
+			name:    "status and header",
+			primary: &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`{}`)},
+			mirror:  &capturedResponse{statusCode: 500, header: http.Header{"Content-Type": {"text/plain"}}, body: []byte(`{}`)},
+			want:    []string{"status:", "header:Content-Type"},
+		},
+		{
+			name:    "JSON compared structurally",
+			primary: &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`{"a":1,"b":[1,2]}`)},
+			mirror:  &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`{ "b": [1, 3], "a": 1.0 }`)},
+			want:    []string{"body:b.1"},
+		},
+		{
+			name:    "ignored paths",
+			primary: &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`{"timestamp":1,"a":1}`)},
+			mirror:  &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`{"timestamp":2,"a":1}`)},
+		},
+		{
+			name:    "missing key",
+			primary: &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`{"a":1}`)},
+			mirror:  &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`{"a":1,"b":2}`)},
+			want:    []string{"body:b"},
+		},
+		{
+			name:    "64-bit IDs that float64 can't tell apart",
+			primary: &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`{"id":9007199254740993}`)},
+			mirror:  &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`{"id":9007199254740992}`)},
+			want:    []string{"body:id"},
+		},
+		{
+			name:    "bodies that aren't JSON",
+			primary: &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`hello`)},
+			mirror:  &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`hullo`)},
+			want:    []string{"body:"},
+		},
+		{
+			name:    "trailing data is no JSON",
+			primary: &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`{} {}`)},
+			mirror:  &capturedResponse{statusCode: 200, header: jsonHeader, body: []byte(`{}`)},
+			want:    []string{"body:"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, d := range comparer.diff(tt.primary, tt.mirror) {
+				got = append(got, string(d.Kind)+":"+d.Path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
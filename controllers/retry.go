@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/3box/go-proxy/common/config"
+	"github.com/3box/go-proxy/common/headers"
+	"github.com/3box/go-proxy/common/metric"
+)
+
+// idempotentMethods can be sent more than once with the same effect, RFC 9110 section 9.2.2
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// retryPolicy is the retry config in the form the proxy looks it up
+type retryPolicy struct {
+	maxAttempts       int
+	initialBackoff    time.Duration
+	maxBackoff        time.Duration
+	retryableStatuses map[int]bool
+	budget            float64
+	budgetWindow      time.Duration
+	minRetries        int
+}
+
+func newRetryPolicy(cfg config.RetryConfig) *retryPolicy {
+	policy := &retryPolicy{
+		maxAttempts:       cfg.MaxAttempts,
+		initialBackoff:    cfg.InitialBackoff,
+		maxBackoff:        cfg.MaxBackoff,
+		retryableStatuses: make(map[int]bool, len(cfg.RetryableStatuses)),
+		budget:            cfg.Budget,
+		budgetWindow:      cfg.BudgetWindow,
+		minRetries:        cfg.MinRetries,
+	}
+	for _, status := range cfg.RetryableStatuses {
+		policy.retryableStatuses[status] = true
+	}
+	return policy
+}
+
+// allows reports whether the request may be retried at all
+func (_this *retryPolicy) allows(r *http.Request) bool {
+	if _this.maxAttempts < 2 {
+		return false
+	}
+	return idempotentMethods[r.Method] || r.Header.Get(headers.IdempotencyKeyHeader) != ""
+}
+
+// retryable reports whether the outcome of an attempt calls for a retry, and why
+func (_this *retryPolicy) retryable(resp *http.Response, err error) (string, bool) {
+	if err != nil {
+		return "error", true
+	}
+	if _this.retryableStatuses[resp.StatusCode] {
+		return "status", true
+	}
+	return "", false
+}
+
+// backoff returns the delay before a retry using full jitter, so clients retrying at the same time spread out
+func (_this *retryPolicy) backoff(retry int) time.Duration {
+	ceiling := _this.initialBackoff << (retry - 1)
+	if ceiling <= 0 || ceiling > _this.maxBackoff {
+		ceiling = _this.maxBackoff
+	}
+	return rand.N(ceiling + 1)
+}
+
+// retryBudget counts requests and retries over fixed windows
+type retryBudget struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+func newRetryBudget() *retryBudget {
+	return &retryBudget{windowStart: time.Now()}
+}
+
+// roll must be called with the lock held
+func (_this *retryBudget) roll(policy *retryPolicy) {
+	if now := time.Now(); now.Sub(_this.windowStart) >= policy.budgetWindow {
+		_this.windowStart = now
+		_this.requests = 0
+		_this.retries = 0
+	}
+}
+
+func (_this *retryBudget) recordRequest(policy *retryPolicy) {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	_this.roll(policy)
+	_this.requests++
+}
+
+// withdraw reserves a retry, reporting false when the budget is spent
+func (_this *retryBudget) withdraw(policy *retryPolicy) bool {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	_this.roll(policy)
+	if _this.retries >= policy.minRetries && float64(_this.retries) >= policy.budget*float64(_this.requests) {
+		return false
+	}
+	_this.retries++
+	return true
+}
+
+// bufferRequestBody reads the body of a request so it can be resent, leaving it readable. Bodies larger than limit
+// are not buffered.
+func bufferRequestBody(r *http.Request, limit int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil, true
+	}
+	if r.ContentLength > limit {
+		return nil, false
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(buf)) > limit {
+		// Hand what was read back to the single attempt, followed by the rest of the body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, false
+	}
+	return buf, true
+}
+
+// shouldRetry decides whether a failed attempt is retried, spending the retry budget
+func (_this *proxyController) shouldRetry(reqCtx requestContext, resp *http.Response, err error) bool {
+	// The client is gone, there is nobody left to answer
+	if clientGone(reqCtx) {
+		return false
+	}
+	policy := reqCtx.state.retry
+	reason, retryable := policy.retryable(resp, err)
+	if !retryable {
+		return false
+	}
+
+	result := "retried"
+	allowed := _this.retryBudget.withdraw(policy)
+	if !allowed {
+		result = "budget_exhausted"
+	}
+	_ = _this.metrics.RecordCount(
+		_this.ctx,
+		metric.MetricProxyRetries,
+		attribute.String("method", reqCtx.request.Method),
+		attribute.String("route", reqCtx.route.name),
+		attribute.String("backend", reqCtx.backend.name),
+		attribute.String("reason", reason),
+		attribute.String("result", result),
+	)
+
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	_this.logger.Warnw("proxy request failed, "+result,
+		"error", err,
+		"status", status,
+		"attempt", reqCtx.attempt,
+		"backend", reqCtx.backend.name,
+		"trace_id", reqCtx.traceID,
+	)
+	return allowed
+}
+
+// waitForRetry sleeps before a retry, reporting false when the client went away in the meantime
+func (_this *proxyController) waitForRetry(ctx context.Context, policy *retryPolicy, retry int) bool {
+	timer := time.NewTimer(policy.backoff(retry))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/3box/go-proxy/common/config"
+)
+
+func TestRetryBudgetWithdraw(t *testing.T) {
+	policy := newRetryPolicy(config.RetryConfig{Budget: 0.2, MinRetries: 2, BudgetWindow: time.Minute})
+
+	tests := []struct {
+		name     string
+		requests int
+		// withdrawn retries are spent before the window is checked
+		withdrawn int
+		expire    bool
+		want      bool
+	}{
+		{name: "minimum retries without requests", requests: 0, withdrawn: 1, want: true},
+		{name: "minimum retries spent", requests: 0, withdrawn: 2, want: false},
+		{name: "minimum retries exceed the budget", requests: 5, withdrawn: 1, want: true},
+		{name: "within the budget", requests: 20, withdrawn: 3, want: true},
+		{name: "budget spent", requests: 20, withdrawn: 4, want: false},
+		{name: "budget spent in an expired window", requests: 20, withdrawn: 4, expire: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget := newRetryBudget()
+			for i := 0; i < tt.requests; i++ {
+				budget.recordRequest(policy)
+			}
+			for i := 0; i < tt.withdrawn; i++ {
+				if !budget.withdraw(policy) {
+					t.Fatalf("retry %d was denied", i)
+				}
+			}
+			if tt.expire {
+				budget.windowStart = budget.windowStart.Add(-policy.budgetWindow)
+			}
+			if got := budget.withdraw(policy); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryBudgetWindowReset(t *testing.T) {
+	policy := newRetryPolicy(config.RetryConfig{Budget: 0.5, MinRetries: 1, BudgetWindow: time.Minute})
+	budget := newRetryBudget()
+
+	steps := []struct {
+		action string
+		want   bool
+	}{
+		{action: "withdraw", want: true},
+		{action: "withdraw", want: false},
+		{action: "request"},
+		{action: "request"},
+		{action: "request"},
+		{action: "request"},
+		// Four requests make room for a second retry
+		{action: "withdraw", want: true},
+		{action: "withdraw", want: false},
+		// The new window forgets both requests and retries
+		{action: "expire"},
+		{action: "withdraw", want: true},
+		{action: "withdraw", want: false},
+	}
+	for i, step := range steps {
+		switch step.action {
+		case "request":
+			budget.recordRequest(policy)
+		case "expire":
+			budget.windowStart = budget.windowStart.Add(-policy.budgetWindow)
+		case "withdraw":
+			if got := budget.withdraw(policy); got != step.want {
+				t.Fatalf("step %d: got %t, want %t", i, got, step.want)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyAllows(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxAttempts int
+		method      string
+		key         string
+		want        bool
+	}{
+		{name: "idempotent method", maxAttempts: 3, method: http.MethodGet, want: true},
+		{name: "retries disabled", maxAttempts: 1, method: http.MethodGet, want: false},
+		{name: "non-idempotent method", maxAttempts: 3, method: http.MethodPost, want: false},
+		{name: "non-idempotent method with idempotency key", maxAttempts: 3, method: http.MethodPost, key: "abc", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := newRetryPolicy(config.RetryConfig{MaxAttempts: tt.maxAttempts})
+			r := httptest.NewRequest(tt.method, "/", nil)
+			if tt.key != "" {
+				r.Header.Set("Idempotency-Key", tt.key)
+			}
+			if got := policy.allows(r); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := newRetryPolicy(config.RetryConfig{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond})
+
+	tests := []struct {
+		retry   int
+		ceiling time.Duration
+	}{
+		{retry: 1, ceiling: 10 * time.Millisecond},
+		{retry: 2, ceiling: 20 * time.Millisecond},
+		{retry: 3, ceiling: 40 * time.Millisecond},
+		{retry: 4, ceiling: 50 * time.Millisecond},
+		// The shift overflows long before this, which must still stay within the maximum
+		{retry: 80, ceiling: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if got := policy.backoff(tt.retry); got < 0 || got > tt.ceiling {
+				t.Fatalf("retry %d: got %s, want within [0, %s]", tt.retry, got, tt.ceiling)
+			}
+		}
+	}
+}
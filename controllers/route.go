@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/3box/go-proxy/common/config"
+)
+
+// RouteContextKey holds the name of the route a request was proxied through in the gin context
+const RouteContextKey = "go-proxy.route"
+
+const (
+	hostPreserve = "preserve"
+	hostOverride = "override"
+)
+
+// route sends the requests it matches to its own target
+type route struct {
+	name string
+	// matcher is nil for the default route, which matches every request
+	matcher   *requestMatcher
+	pool      *backendPool
+	transport *http.Transport
+	// client has no timeout of its own, requests are bound by timeout and streamIdleTimeout instead
+	client            *http.Client
+	timeout           time.Duration
+	streamIdleTimeout time.Duration
+	rewriteFrom       string
+	rewriteTo         string
+	host              config.UpstreamHostConfig
+	// mirrors restricts the mirrors receiving copies of the route's requests, nil allows all of them
+	mirrors        map[string]bool
+	disableMirrors bool
+}
+
+func newRoute(cfg config.RouteConfig, backends map[string]*backend) (*route, error) {
+	pool, err := newBackendPool(cfg.TargetURLs, cfg.LoadBalancer, backends)
+	if err != nil {
+		return nil, fmt.Errorf("invalid targets for route %s: %w", cfg.Name, err)
+	}
+	matcher, err := newRequestMatcher(cfg.Match)
+	if err != nil {
+		return nil, fmt.Errorf("invalid match for route %s: %w", cfg.Name, err)
+	}
+	if cfg.Rewrite.From == "" && cfg.Rewrite.To != "" {
+		return nil, fmt.Errorf("path rewrite to %q for route %s is missing the prefix to replace", cfg.Rewrite.To, cfg.Name)
+	}
+
+	r := &route{
+		name:              cfg.Name,
+		matcher:           matcher,
+		pool:              pool,
+		transport:         newTransport(cfg.DialTimeout, cfg.UpstreamTLS),
+		timeout:           cfg.Timeout,
+		streamIdleTimeout: cfg.StreamIdleTimeout,
+		rewriteFrom:       cfg.Rewrite.From,
+		rewriteTo:         cfg.Rewrite.To,
+		host:              cfg.Host,
+		disableMirrors:    cfg.DisableMirrors,
+	}
+	r.client = &http.Client{Transport: r.transport}
+	if len(cfg.Mirrors) > 0 {
+		r.mirrors = make(map[string]bool, len(cfg.Mirrors))
+		for _, name := range cfg.Mirrors {
+			r.mirrors[name] = true
+		}
+	}
+	return r, nil
+}
+
+// newDefaultRoute sends the requests no route matched to Proxy.TargetURLs. It shares the mirrors' transport unless
+// its TLS connections need settings of their own.
+func newDefaultRoute(cfg config.ProxyConfig, transport *http.Transport, backends map[string]*backend) (*route, error) {
+	pool, err := newBackendPool(cfg.TargetURLs, cfg.LoadBalancer, backends)
+	if err != nil {
+		return nil, fmt.Errorf("invalid targets: %w", err)
+	}
+	if cfg.UpstreamTLS != (config.UpstreamTLSConfig{}) {
+		transport = newTransport(cfg.DialTimeout, cfg.UpstreamTLS)
+	}
+	return &route{
+		name:              config.DefaultRouteName,
+		pool:              pool,
+		transport:         transport,
+		client:            &http.Client{Transport: transport},
+		timeout:           cfg.Timeout,
+		streamIdleTimeout: cfg.StreamIdleTimeout,
+		host:              cfg.Host,
+	}, nil
+}
+
+func newTransport(dialTimeout time.Duration, upstreamTLS config.UpstreamTLSConfig) *http.Transport {
+	transport := &http.Transport{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 100,
+		// Bound idle connections so transports replaced by a reload eventually release theirs
+		IdleConnTimeout:    90 * time.Second,
+		DisableKeepAlives:  false,
+		DisableCompression: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialer := &net.Dialer{
+				Timeout: dialTimeout,
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+	if upstreamTLS.ServerName != "" {
+		transport.TLSClientConfig = &tls.Config{ServerName: upstreamTLS.ServerName}
+	}
+	return transport
+}
+
+func (_this *route) match(r *http.Request) bool {
+	return _this.matcher == nil || _this.matcher.match(r)
+}
+
+// rewritePath returns the path sent to the route's target
+func (_this *route) rewritePath(path string) string {
+	if _this.rewriteFrom != "" && strings.HasPrefix(path, _this.rewriteFrom) {
+		return _this.rewriteTo + strings.TrimPrefix(path, _this.rewriteFrom)
+	}
+	return path
+}
+
+// upstreamHost returns the Host header sent to the route's target, empty for the host of the target URL
+func (_this *route) upstreamHost(r *http.Request) string {
+	switch _this.host.Mode {
+	case hostPreserve:
+		return r.Host
+	case hostOverride:
+		return _this.host.Value
+	}
+	return ""
+}
+
+// checkHost returns the Host header of the route's health checks, empty for the host of the backend URL. There is no
+// client host to preserve, so only an override applies.
+func (_this *route) checkHost() string {
+	if _this.host.Mode == hostOverride {
+		return _this.host.Value
+	}
+	return ""
+}
+
+// allowsMirror reports whether the mirror may receive copies of the route's requests
+func (_this *route) allowsMirror(mirror *mirrorTarget) bool {
+	if _this.disableMirrors {
+		return false
+	}
+	return _this.mirrors == nil || _this.mirrors[mirror.name]
+}
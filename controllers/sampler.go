@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type samplingMode string
+
+const (
+	samplingRandom        samplingMode = "random"
+	samplingDeterministic samplingMode = "deterministic"
+)
+
+// requestKeyFunc extracts a key identifying the logical entity a request is about
+type requestKeyFunc func(r *http.Request, traceID string) string
+
+// newRequestKeyFunc parses a key spec of the form "header:<name>", "trace_id" or "path:<segment index>".
+// Path segments are zero-based, so "path:3" selects the stream ID in /api/v0/streams/<id>.
+func newRequestKeyFunc(spec string) (requestKeyFunc, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "header":
+		if arg == "" {
+			return nil, fmt.Errorf("missing header name in key %q", spec)
+		}
+		header := http.CanonicalHeaderKey(arg)
+		return func(r *http.Request, _ string) string {
+			return r.Header.Get(header)
+		}, nil
+	case "trace_id":
+		return func(_ *http.Request, traceID string) string {
+			return traceID
+		}, nil
+	case "path":
+		index, err := strconv.Atoi(arg)
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("invalid path segment index in key %q", spec)
+		}
+		return func(r *http.Request, _ string) string {
+			segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+			if index < len(segments) {
+				return segments[index]
+			}
+			return ""
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown key %q", spec)
+	}
+}
+
+// sampler decides whether a request should be mirrored
+type sampler struct {
+	rate float64
+	key  requestKeyFunc
+}
+
+// newSampler samples every request when rate is nil, and none when it is zero
+func newSampler(rate *float64, key string) (*sampler, error) {
+	s := &sampler{rate: 1}
+	if rate != nil {
+		if *rate < 0 || *rate > 1 {
+			return nil, fmt.Errorf("sample rate %v is not within [0, 1]", *rate)
+		}
+		s.rate = *rate
+	}
+	if key != "" {
+		keyFunc, err := newRequestKeyFunc(key)
+		if err != nil {
+			return nil, err
+		}
+		s.key = keyFunc
+	}
+	return s, nil
+}
+
+// sample returns whether the request was selected and how the decision was made. With a key configured, the same
+// key value always gets the same decision. Requests without a key value fall back to random sampling.
+func (_this *sampler) sample(r *http.Request, traceID string) (bool, samplingMode) {
+	if _this.key != nil {
+		if key := _this.key(r, traceID); key != "" {
+			return hashFraction(key) < _this.rate, samplingDeterministic
+		}
+	}
+	if _this.rate >= 1 {
+		return true, samplingRandom
+	}
+	return rand.Float64() < _this.rate, samplingRandom
+}
+
+// hashFraction maps a key onto [0, 1)
+func hashFraction(key string) float64 {
+	return float64(hashKey(key)) / (math.MaxUint64 + 1.0)
+}
+
+// hashKey hashes a key with FNV-64a. FNV barely changes the high bits for keys that only differ in their last
+// characters, such as sequential IDs, so the result goes through the murmur3 finalizer to spread them.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	hash := h.Sum64()
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errUpstreamTimeout = errors.New("upstream timeout")
+	errStreamIdle      = errors.New("stream idle timeout")
+)
+
+// streamBufferSize bounds the chunks read from streaming responses, each one is flushed to the client right away
+const streamBufferSize = 32 << 10
+
+// attemptDeadline cancels an upstream attempt once the route timeout passed, zero meaning no timeout. Streaming
+// responses and upgrades stop it once they start, a stream is then only cut when it stays idle.
+type attemptDeadline struct {
+	timer *time.Timer
+}
+
+func newAttemptContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelCauseFunc, *attemptDeadline) {
+	ctx, cancel := context.WithCancelCause(parent)
+	deadline := &attemptDeadline{}
+	if timeout > 0 {
+		deadline.timer = time.AfterFunc(timeout, func() { cancel(errUpstreamTimeout) })
+	}
+	return ctx, cancel, deadline
+}
+
+func (_this *attemptDeadline) stop() {
+	if _this != nil && _this.timer != nil {
+		_this.timer.Stop()
+	}
+}
+
+// upstreamError names the timeout behind an error caused by cancelling the attempt context
+func upstreamError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	cause := context.Cause(ctx)
+	if errors.Is(err, cause) {
+		return err
+	}
+	if errors.Is(cause, errUpstreamTimeout) || errors.Is(cause, errStreamIdle) {
+		return fmt.Errorf("%w: %w", cause, err)
+	}
+	return err
+}
+
+// isStreamingResponse reports whether the response is sent as it is produced: server-sent events, or a body of
+// unknown length such as a chunked one
+func isStreamingResponse(resp *http.Response) bool {
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && mediaType == "text/event-stream" {
+		return true
+	}
+	return resp.ContentLength < 0
+}
+
+// copyStreaming writes every chunk to the client as soon as it arrives, cancelling the attempt when no chunk arrived
+// within the idle timeout
+func copyStreaming(reqCtx requestContext, w gin.ResponseWriter, body io.Reader) error {
+	idleTimeout := reqCtx.route.streamIdleTimeout
+	var idle *time.Timer
+	if idleTimeout > 0 {
+		idle = time.AfterFunc(idleTimeout, func() { reqCtx.cancel(errStreamIdle) })
+		defer idle.Stop()
+	}
+
+	buf := make([]byte, streamBufferSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if idle != nil {
+				idle.Reset(idleTimeout)
+			}
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+			w.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return upstreamError(reqCtx.request.Context(), err)
+		}
+	}
+}
+
+// clientGone reports whether the client of a proxied request went away
+func clientGone(reqCtx requestContext) bool {
+	return reqCtx.ginContext.Request.Context().Err() != nil
+}
@@ -0,0 +1,147 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/3box/go-proxy/common/config"
+	"github.com/3box/go-proxy/common/logging"
+	"github.com/3box/go-proxy/common/metric"
+	"github.com/3box/go-proxy/common/recording"
+)
+
+// trafficRecorder writes selected requests to disk from a single goroutine so that slow disks never block proxying
+type trafficRecorder struct {
+	ctx             context.Context
+	logger          logging.Logger
+	metrics         metric.MetricService
+	filter          requestFilter
+	sampler         *sampler
+	includeResponse bool
+	// includeCredentials keeps credential-like header values, see config.RecordingConfig
+	includeCredentials bool
+	writer             *recording.Writer
+	queue              chan *recording.Record
+	stop               chan struct{}
+	stopOnce           sync.Once
+	done               chan struct{}
+}
+
+func newTrafficRecorder(
+	ctx context.Context,
+	cfg config.RecordingConfig,
+	logger logging.Logger,
+	metrics metric.MetricService,
+) (*trafficRecorder, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	filter, err := newRequestFilter(cfg.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules: %w", err)
+	}
+	recordingSampler, err := newSampler(cfg.SampleRate, cfg.SampleKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sampling: %w", err)
+	}
+	if cfg.QueueSize <= 0 {
+		return nil, fmt.Errorf("queue size %d must be positive", cfg.QueueSize)
+	}
+	writer, err := recording.NewWriter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := &trafficRecorder{
+		ctx:                ctx,
+		logger:             logger,
+		metrics:            metrics,
+		filter:             filter,
+		sampler:            recordingSampler,
+		includeResponse:    cfg.IncludeResponse,
+		includeCredentials: cfg.IncludeCredentials,
+		writer:             writer,
+		queue:              make(chan *recording.Record, cfg.QueueSize),
+		stop:               make(chan struct{}),
+		done:               make(chan struct{}),
+	}
+	go recorder.run()
+	return recorder, nil
+}
+
+// selects reports whether the request should be recorded
+func (_this *trafficRecorder) selects(r *http.Request, traceID string) bool {
+	if !_this.filter.match(r) {
+		return false
+	}
+	sampled, _ := _this.sampler.sample(r, traceID)
+	return sampled
+}
+
+// record queues a record for writing, dropping it when the queue is full
+func (_this *trafficRecorder) record(rec *recording.Record) {
+	select {
+	case _this.queue <- rec:
+	default:
+		_this.recordResult(rec.Method, rec.Route, "dropped")
+	}
+}
+
+func (_this *trafficRecorder) run() {
+	defer close(_this.done)
+
+	for {
+		select {
+		case rec := <-_this.queue:
+			_this.write(rec)
+		case <-_this.stop:
+			// Flush whatever is still queued before closing the current file
+			for {
+				select {
+				case rec := <-_this.queue:
+					_this.write(rec)
+				default:
+					if err := _this.writer.Close(); err != nil {
+						_this.logger.Errorw("failed to close recording", "error", err)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (_this *trafficRecorder) write(rec *recording.Record) {
+	if err := _this.writer.Write(rec); err != nil {
+		_this.logger.Errorw("failed to write recording",
+			"error", err,
+			"trace_id", rec.TraceID,
+		)
+		_this.recordResult(rec.Method, rec.Route, "error")
+		return
+	}
+	_this.recordResult(rec.Method, rec.Route, "written")
+}
+
+func (_this *trafficRecorder) recordResult(method, route, result string) {
+	_ = _this.metrics.RecordRequest(
+		_this.ctx,
+		metric.MetricRecording,
+		method,
+		route,
+		attribute.String("result", result),
+	)
+}
+
+// close stops the recorder once queued records are written. Callers must stop recording requests first.
+func (_this *trafficRecorder) close() {
+	_this.stopOnce.Do(func() {
+		close(_this.stop)
+	})
+	<-_this.done
+}
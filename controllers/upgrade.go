@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/3box/go-proxy/common/config"
+	"github.com/3box/go-proxy/common/headers"
+	"github.com/3box/go-proxy/common/metric"
+)
+
+const mirrorUpgradeHandshake = "handshake"
+
+// isUpgradeRequest reports whether the client asks to switch protocols, e.g. to a WebSocket
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+// headerHasToken reports whether a comma-separated header contains the token, ignoring case
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyUpgrade forwards the upgrade request and, once the backend switched protocols, copies bytes both ways until
+// either side closes. Upgraded connections are not bound by Proxy.Timeout.
+func (_this *proxyController) proxyUpgrade(c *gin.Context, state *proxyState, route *route, header http.Header, traceID string) {
+	// The upgrade headers are hop-by-hop, but are exactly what asks the backend to switch protocols
+	header = withUpgrade(header, c.Request.Header)
+	_this.mirrorUpgrade(c, state, route, header, traceID)
+
+	backend := route.pool.pick(c.Request, traceID, nil)
+	// The route timeout bounds the handshake, the upgraded connection lives on once the backend switched protocols
+	attemptCtx, cancel, deadline := newAttemptContext(c.Request.Context(), route.timeout)
+	defer cancel(nil)
+	defer deadline.stop()
+	req, err := newUpstreamRequest(
+		attemptCtx,
+		c.Request.Method,
+		backend.url,
+		route.rewritePath(c.Request.URL.Path),
+		c.Request.URL.RawQuery,
+		header,
+		http.NoBody,
+		0,
+		traceID,
+	)
+	if err != nil {
+		_this.logger.Errorw("failed to create upgrade request",
+			"error", err,
+			"trace_id", traceID,
+		)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
+		return
+	}
+	req.Host = route.upstreamHost(c.Request)
+
+	reqCtx := requestContext{
+		reqType:    proxyRequest,
+		state:      state,
+		route:      route,
+		backend:    backend,
+		ginContext: c,
+		request:    req,
+		startTime:  time.Now(),
+		targetURL:  backend.url,
+		traceID:    traceID,
+		cancel:     cancel,
+		deadline:   deadline,
+	}
+
+	// The transport hands back the raw connection when the backend switches protocols
+	resp, err := route.transport.RoundTrip(req)
+	err = upstreamError(attemptCtx, err)
+	if err != nil {
+		_this.recordBackendResult(reqCtx, false)
+		_this.recordUpgrade(reqCtx, "error", time.Since(reqCtx.startTime))
+		_this.logger.Errorw("upgrade error",
+			"error", err,
+			"url", req.URL.String(),
+			"trace_id", traceID,
+		)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "proxy error"})
+		return
+	}
+	_this.recordBackendResult(reqCtx, resp.StatusCode < http.StatusInternalServerError)
+
+	// The backend refused to upgrade, its answer is an ordinary response
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		_this.recordUpgrade(reqCtx, "refused", time.Since(reqCtx.startTime))
+		_this.streamResponse(reqCtx, resp, reqCtx.startTime, false)
+		return
+	}
+	backendConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		_ = resp.Body.Close()
+		_this.recordUpgrade(reqCtx, "error", time.Since(reqCtx.startTime))
+		c.JSON(http.StatusBadGateway, gin.H{"error": "proxy error"})
+		return
+	}
+	defer backendConn.Close()
+	deadline.stop()
+
+	clientConn, clientBuf, err := c.Writer.Hijack()
+	if err != nil {
+		_this.recordUpgrade(reqCtx, "error", time.Since(reqCtx.startTime))
+		_this.logger.Errorw("failed to take over the client connection",
+			"error", err,
+			"trace_id", traceID,
+		)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "upgrade not supported"})
+		return
+	}
+	defer clientConn.Close()
+	// Deadlines set by the server for the handshake must not cut the upgraded connection short
+	_ = clientConn.SetDeadline(time.Time{})
+
+	if err = writeSwitchingProtocols(clientBuf.Writer, resp, traceID); err != nil {
+		_this.recordUpgrade(reqCtx, "error", time.Since(reqCtx.startTime))
+		return
+	}
+
+	atomic.AddInt64(backend.activeConns, 1)
+	_this.recordActiveConnections(reqCtx)
+	defer func() {
+		atomic.AddInt64(backend.activeConns, -1)
+		_this.recordActiveConnections(reqCtx)
+	}()
+
+	_this.logger.Infow("upgraded connection opened",
+		"protocol", resp.Header.Get("Upgrade"),
+		"url", req.URL.String(),
+		"backend", backend.name,
+		"trace_id", traceID,
+	)
+	sent, received := pipeConnections(clientConn, clientBuf.Reader, backendConn)
+	duration := time.Since(reqCtx.startTime)
+	_this.recordUpgrade(reqCtx, "upgraded", duration)
+	_this.logger.Infow("upgraded connection closed",
+		"protocol", resp.Header.Get("Upgrade"),
+		"backend", backend.name,
+		"bytes_sent", sent,
+		"bytes_received", received,
+		"duration", duration,
+		"trace_id", traceID,
+	)
+}
+
+// withUpgrade sets the protocols requested or chosen in src as the upgrade headers of dst, which is returned
+func withUpgrade(dst, src http.Header) http.Header {
+	headers.RemoveHopByHop(dst)
+	dst.Set(headers.ConnectionHeader, "Upgrade")
+	dst[headers.UpgradeHeader] = src.Values(headers.UpgradeHeader)
+	return dst
+}
+
+// writeSwitchingProtocols relays the backend's 101 response to the client
+func writeSwitchingProtocols(w *bufio.Writer, resp *http.Response, traceID string) error {
+	header := withUpgrade(resp.Header.Clone(), resp.Header)
+	header.Set(headers.ProxiedByHeader, config.ServiceName)
+	header.Set(headers.TraceIDHeader, traceID)
+
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %s\r\n", resp.Status); err != nil {
+		return err
+	}
+	if err := header.Write(w); err != nil {
+		return err
+	}
+	if _, err := w.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// pipeConnections copies bytes both ways until either side is done, returning the bytes sent to the backend and
+// received from it. Bytes the client sent along with the handshake are still buffered in clientReader.
+func pipeConnections(clientConn net.Conn, clientReader io.Reader, backendConn io.ReadWriteCloser) (int64, int64) {
+	var sent, received int64
+	// Closing both sides unblocks the other copy once one of them is done
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			_ = clientConn.Close()
+			_ = backendConn.Close()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer closeBoth()
+		sent, _ = io.Copy(backendConn, clientReader)
+	}()
+	go func() {
+		defer wg.Done()
+		defer closeBoth()
+		received, _ = io.Copy(clientConn, backendConn)
+	}()
+	wg.Wait()
+	return sent, received
+}
+
+// mirrorUpgrade sends the handshake to the mirrors configured for it. There is no body, and the mirror connection is
+// closed as soon as the mirror answers.
+func (_this *proxyController) mirrorUpgrade(c *gin.Context, state *proxyState, route *route, header http.Header, traceID string) {
+	for _, mirror := range _this.selectMirrors(c, state, route, traceID) {
+		job := &mirrorJob{
+			mirror:   mirror,
+			route:    route,
+			method:   c.Request.Method,
+			path:     c.Request.URL.Path,
+			rawQuery: c.Request.URL.RawQuery,
+			header:   header,
+			traceID:  traceID,
+			state:    state,
+		}
+		if mirror.cfg.Upgrades != mirrorUpgradeHandshake {
+			_this.dispatcher.drop(job, dropUpgrade)
+			continue
+		}
+		_this.dispatcher.enqueue(job)
+	}
+}
+
+func (_this *proxyController) recordUpgrade(reqCtx requestContext, result string, duration time.Duration) {
+	protocol := strings.ToLower(reqCtx.request.Header.Get("Upgrade"))
+	if reqCtx.request.Method == http.MethodConnect {
+		protocol = tunnelProtocol
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("backend", reqCtx.backend.name),
+		attribute.String("protocol", protocol),
+		attribute.String("result", result),
+	}
+	_ = _this.metrics.RecordRequest(_this.ctx, metric.MetricProxyUpgrade, reqCtx.request.Method, reqCtx.route.name, attrs...)
+	_ = _this.metrics.RecordDuration(_this.ctx, metric.MetricProxyUpgrade, reqCtx.request.Method, reqCtx.route.name, duration, attrs...)
+}
@@ -0,0 +1,178 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/3box/go-proxy/common/headers"
+	"github.com/3box/go-proxy/common/logging"
+	"github.com/3box/go-proxy/common/recording"
+)
+
+type Options struct {
+	TargetURL string
+	// Speed scales the recorded gaps between requests, 1 keeps the original timing and 0 sends as fast as possible
+	Speed float64
+	// Rate caps the number of requests sent per second and replaces the recorded timing, zero disables it
+	Rate        float64
+	Concurrency int
+	Timeout     time.Duration
+}
+
+// Replayer sends recorded traffic to a target
+type Replayer struct {
+	logger logging.Logger
+	opts   Options
+	target *url.URL
+	client *http.Client
+}
+
+func NewReplayer(logger logging.Logger, opts Options) (*Replayer, error) {
+	target, err := url.Parse(opts.TargetURL)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("invalid target URL %q", opts.TargetURL)
+	}
+	if opts.Speed < 0 || opts.Rate < 0 {
+		return nil, errors.New("speed and rate must not be negative")
+	}
+	if opts.Concurrency <= 0 {
+		return nil, errors.New("concurrency must be positive")
+	}
+
+	return &Replayer{
+		logger: logger,
+		opts:   opts,
+		target: target,
+		client: &http.Client{
+			Timeout: opts.Timeout,
+			// Report redirects as they were recorded instead of following them
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+// Replay sends every record of the given files, in order, and returns a summary of the responses
+func (_this *Replayer) Replay(ctx context.Context, files []string) (*Summary, error) {
+	records := make(chan *recording.Record, _this.opts.Concurrency)
+	summary := newSummary()
+
+	var wg sync.WaitGroup
+	for i := 0; i < _this.opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rec := range records {
+				summary.add(_this.send(ctx, rec))
+			}
+		}()
+	}
+
+	err := _this.schedule(ctx, files, records)
+	close(records)
+	wg.Wait()
+	summary.finish()
+	return summary, err
+}
+
+// schedule feeds records to the workers, pacing them according to the options
+func (_this *Replayer) schedule(ctx context.Context, files []string, records chan<- *recording.Record) error {
+	var ticker *time.Ticker
+	if _this.opts.Rate > 0 {
+		ticker = time.NewTicker(time.Duration(float64(time.Second) / _this.opts.Rate))
+		defer ticker.Stop()
+	}
+
+	var firstRecorded, started time.Time
+	for _, file := range files {
+		reader, err := recording.NewReader(file)
+		if err != nil {
+			return err
+		}
+		for {
+			rec, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				_ = reader.Close()
+				return fmt.Errorf("failed to read %s: %w", file, err)
+			}
+
+			var wait <-chan time.Time
+			switch {
+			case ticker != nil:
+				wait = ticker.C
+			case _this.opts.Speed > 0:
+				if firstRecorded.IsZero() {
+					firstRecorded, started = rec.Timestamp, time.Now()
+				}
+				offset := time.Duration(float64(rec.Timestamp.Sub(firstRecorded)) / _this.opts.Speed)
+				wait = time.After(time.Until(started.Add(offset)))
+			}
+			if wait != nil {
+				select {
+				case <-wait:
+				case <-ctx.Done():
+					_ = reader.Close()
+					return ctx.Err()
+				}
+			}
+
+			select {
+			case records <- rec:
+			case <-ctx.Done():
+				_ = reader.Close()
+				return ctx.Err()
+			}
+		}
+		_ = reader.Close()
+	}
+	return nil
+}
+
+func (_this *Replayer) send(ctx context.Context, rec *recording.Record) result {
+	targetPath := rec.Path
+	if rec.Query != "" {
+		targetPath += "?" + rec.Query
+	}
+
+	req, err := http.NewRequestWithContext(ctx, rec.Method, _this.target.String()+targetPath, bytes.NewReader(rec.Body))
+	if err != nil {
+		return result{err: err}
+	}
+
+	// Send the recorded headers and trace ID the same way the proxy does
+	headers.Copy(req.Header, rec.Header)
+	headers.RemoveHopByHop(req.Header)
+	traceID := rec.TraceID
+	if traceID == "" {
+		traceID = headers.TraceID(rec.Header)
+	}
+	req.Header.Set(headers.TraceIDHeader, traceID)
+	req.ContentLength = int64(len(rec.Body))
+
+	startTime := time.Now()
+	resp, err := _this.client.Do(req)
+	if err != nil {
+		_this.logger.Debugw("replay error",
+			"error", err,
+			"method", rec.Method,
+			"path", rec.Path,
+			"trace_id", traceID,
+		)
+		return result{err: err, latency: time.Since(startTime)}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	return result{statusCode: resp.StatusCode, latency: time.Since(startTime)}
+}
@@ -0,0 +1,86 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+type result struct {
+	statusCode int
+	latency    time.Duration
+	err        error
+}
+
+// Summary aggregates the responses of a replay
+type Summary struct {
+	mu          sync.Mutex
+	started     time.Time
+	Elapsed     time.Duration
+	Requests    int
+	Errors      int
+	StatusCodes map[int]int
+	Latencies   []time.Duration
+}
+
+func newSummary() *Summary {
+	return &Summary{
+		started:     time.Now(),
+		StatusCodes: make(map[int]int),
+	}
+}
+
+func (_this *Summary) add(res result) {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	_this.Requests++
+	if res.err != nil {
+		_this.Errors++
+		return
+	}
+	_this.StatusCodes[res.statusCode]++
+	_this.Latencies = append(_this.Latencies, res.latency)
+}
+
+func (_this *Summary) finish() {
+	_this.Elapsed = time.Since(_this.started)
+	sort.Slice(_this.Latencies, func(i, j int) bool {
+		return _this.Latencies[i] < _this.Latencies[j]
+	})
+}
+
+// Print writes a human-readable summary
+func (_this *Summary) Print(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "requests: %d (%d errors) in %s\n", _this.Requests, _this.Errors, _this.Elapsed.Round(time.Millisecond))
+	if _this.Elapsed > 0 {
+		_, _ = fmt.Fprintf(w, "rate: %.1f req/s\n", float64(_this.Requests)/_this.Elapsed.Seconds())
+	}
+
+	codes := make([]int, 0, len(_this.StatusCodes))
+	for code := range _this.StatusCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	_, _ = fmt.Fprintln(w, "status codes:")
+	for _, code := range codes {
+		_, _ = fmt.Fprintf(w, "  %d: %d\n", code, _this.StatusCodes[code])
+	}
+
+	if len(_this.Latencies) == 0 {
+		return
+	}
+	_, _ = fmt.Fprintln(w, "latency:")
+	_, _ = fmt.Fprintf(w, "  min: %s\n", _this.Latencies[0].Round(time.Microsecond))
+	for _, p := range []float64{50, 90, 99} {
+		_, _ = fmt.Fprintf(w, "  p%.0f: %s\n", p, _this.percentile(p).Round(time.Microsecond))
+	}
+	_, _ = fmt.Fprintf(w, "  max: %s\n", _this.Latencies[len(_this.Latencies)-1].Round(time.Microsecond))
+}
+
+func (_this *Summary) percentile(p float64) time.Duration {
+	index := int(float64(len(_this.Latencies)-1) * p / 100)
+	return _this.Latencies[index]
+}
@@ -0,0 +1,14 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// adminRoutes registers the endpoints served on the admin port
+func (_this serverImpl) adminRoutes(router *gin.Engine) {
+	router.GET("/metrics", _this.metricService.GetPrometheusHandler())
+	router.GET("/healthz", _this.healthController.Liveness)
+	router.GET("/readyz", _this.healthController.Readiness)
+	router.POST("/admin/reload", _this.reloadHandler)
+	router.GET("/admin/backends", _this.backendsController.Backends)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/3box/go-proxy/common/config"
+	"github.com/3box/go-proxy/common/logging"
+	"github.com/3box/go-proxy/controllers"
+)
+
+// reloader re-reads the config and swaps it into the running components
+type reloader struct {
+	logger           logging.Logger
+	proxyController  controllers.ProxyController
+	healthController controllers.HealthController
+
+	mu  sync.Mutex
+	cfg *config.Config
+}
+
+func newReloader(
+	cfg *config.Config,
+	logger logging.Logger,
+	proxyController controllers.ProxyController,
+	healthController controllers.HealthController,
+) *reloader {
+	if cfg.LogLevel != "" {
+		if err := logging.SetLevel(cfg.LogLevel); err != nil {
+			logger.Errorw("invalid log level, keeping the current one", "error", err)
+		}
+	}
+	return &reloader{
+		logger:           logger,
+		proxyController:  proxyController,
+		healthController: healthController,
+		cfg:              cfg,
+	}
+}
+
+// reload loads the config again and applies it when it is valid, otherwise the current config is kept
+func (_this *reloader) reload() error {
+	_this.mu.Lock()
+	defer _this.mu.Unlock()
+
+	cfg, err := config.LoadConfig(_this.logger)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	// The proxy controller validates the config, nothing is applied if it fails
+	if err = _this.proxyController.UpdateConfig(cfg); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	_this.healthController.UpdateConfig(cfg)
+	// The level was validated with the config, so it is only applied along with the rest of it
+	if cfg.LogLevel != "" {
+		if err = logging.SetLevel(cfg.LogLevel); err != nil {
+			_this.logger.Errorw("invalid log level, keeping the current one", "error", err)
+		}
+	}
+
+	if changed := restartOnlyChanges(_this.cfg, cfg); len(changed) > 0 {
+		_this.logger.Warnw("config reloaded, some changes only take effect on restart",
+			"settings", strings.Join(changed, ", "),
+		)
+	}
+	_this.cfg = cfg
+	return nil
+}
+
+// restartOnlyChanges lists the settings that differ between two configs but can't be changed at runtime
+func restartOnlyChanges(current, next *config.Config) []string {
+	var changed []string
+	checks := []struct {
+		name          string
+		current, next interface{}
+	}{
+		{"Proxy.ListenPort", current.Proxy.ListenPort, next.Proxy.ListenPort},
+		{"Proxy.TLS", current.Proxy.TLS, next.Proxy.TLS},
+		{"Proxy.AllowedMethods", current.Proxy.AllowedMethods, next.Proxy.AllowedMethods},
+		{"Proxy.DeniedMethods", current.Proxy.DeniedMethods, next.Proxy.DeniedMethods},
+		{"Proxy.MirrorQueue", current.Proxy.MirrorQueue, next.Proxy.MirrorQueue},
+		{"Recording", current.Recording, next.Recording},
+		{"Health.Interval", current.Health.Interval, next.Health.Interval},
+		{"Health.ShutdownDelay", current.Health.ShutdownDelay, next.Health.ShutdownDelay},
+		{"Metrics", current.Metrics, next.Metrics},
+		{"Admin", current.Admin, next.Admin},
+	}
+	for _, check := range checks {
+		if !reflect.DeepEqual(check.current, check.next) {
+			changed = append(changed, check.name)
+		}
+	}
+	return changed
+}
+
+func (_this serverImpl) handleReloadSignal() {
+	_this.wg.Add(1)
+	go func() {
+		defer _this.wg.Done()
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-_this.serverCtx.Done():
+				return
+			case <-hup:
+				_this.applyReload("signal")
+			}
+		}
+	}()
+}
+
+func (_this serverImpl) applyReload(source string) error {
+	_this.logger.Infow("server: reloading config", "source", source)
+	if err := _this.reloader.reload(); err != nil {
+		_this.logger.Errorw("server: config reload failed, keeping the current config",
+			"error", err,
+			"source", source,
+		)
+		return err
+	}
+	_this.logger.Infow("server: config reloaded", "source", source)
+	return nil
+}
+
+// reloadHandler reloads the config on behalf of an admin request carrying the admin token
+func (_this serverImpl) reloadHandler(c *gin.Context) {
+	token := _this.cfg.Admin.Token
+	if token == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "reload endpoint disabled"})
+		return
+	}
+	provided, bearer := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !bearer || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	if err := _this.applyReload("admin"); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "reloaded"})
+}
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"go.opentelemetry.io/otel/attribute"
 
@@ -28,16 +29,21 @@ type Server interface {
 }
 
 type serverImpl struct {
-	ctx             context.Context
-	serverCtx       context.Context
-	serverCtxCancel context.CancelFunc
-	cfg             *config.Config
-	logger          logging.Logger
-	proxyServer     *http.Server
-	metricsServer   *http.Server
-	proxyController controllers.ProxyController
-	metricService   metric.MetricService
-	wg              *sync.WaitGroup
+	ctx                context.Context
+	serverCtx          context.Context
+	serverCtxCancel    context.CancelFunc
+	cfg                *config.Config
+	logger             logging.Logger
+	proxyServer        *http.Server
+	adminServer        *http.Server
+	proxyController    controllers.ProxyController
+	healthController   controllers.HealthController
+	backendsController controllers.BackendsController
+	metricService      metric.MetricService
+	reloader           *reloader
+	allowedMethods     map[string]bool
+	deniedMethods      map[string]bool
+	wg                 *sync.WaitGroup
 }
 
 func NewServer(
@@ -46,8 +52,11 @@ func NewServer(
 	logger logging.Logger,
 	metricService metric.MetricService,
 	proxyController controllers.ProxyController,
+	healthController controllers.HealthController,
+	backendsController controllers.BackendsController,
 ) (*gin.Engine, Server) {
 	router := gin.New()
+	adminRouter := gin.New()
 
 	// Set up a server context
 	serverCtx, serverCtxCancel := context.WithCancel(ctx)
@@ -65,35 +74,62 @@ func NewServer(
 				return serverCtx
 			},
 		},
-		metricsServer: &http.Server{
-			Handler: router,
+		// Admin endpoints live on the metrics port so the proxy port can forward every path
+		adminServer: &http.Server{
+			Handler: adminRouter,
 			Addr:    ":" + cfg.Metrics.ListenPort,
 		},
-		proxyController: proxyController,
-		metricService:   metricService,
-		wg:              &sync.WaitGroup{},
+		proxyController:    proxyController,
+		healthController:   healthController,
+		backendsController: backendsController,
+		metricService:      metricService,
+		reloader:           newReloader(cfg, logger, proxyController, healthController),
+		allowedMethods:     methodSet(cfg.Proxy.AllowedMethods),
+		deniedMethods:      methodSet(cfg.Proxy.DeniedMethods),
+		wg:                 &sync.WaitGroup{},
 	}
 
 	// Add the panic recovery middleware before any routes
 	router.Use(server.panicHandler())
 
-	// Match all paths including root
+	// Match all paths including root. CONNECT requests in authority-form have no path and only reach NoRoute.
 	router.Any("/*path", server.router)
+	router.NoRoute(server.router)
+
+	adminRouter.Use(server.panicHandler())
+	server.adminRoutes(adminRouter)
 
 	return router, server
 }
 
+func methodSet(methods []string) map[string]bool {
+	if len(methods) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		set[strings.ToUpper(method)] = true
+	}
+	return set
+}
+
+// methodAllowed applies the method denylist, then the allowlist when one is configured
+func (_this serverImpl) methodAllowed(method string) bool {
+	if _this.deniedMethods[method] {
+		return false
+	}
+	return _this.allowedMethods == nil || _this.allowedMethods[method]
+}
+
 func (_this serverImpl) router(c *gin.Context) {
+	if !_this.methodAllowed(c.Request.Method) {
+		c.Status(http.StatusMethodNotAllowed)
+		return
+	}
+
 	switch c.Request.Method {
 	case http.MethodGet:
-		{
-			if strings.HasPrefix(c.Request.URL.Path, "/metrics") {
-				_this.metricService.GetPrometheusHandler()(c)
-				return
-			}
-
-			_this.proxyController.ProxyGetRequest(c)
-		}
+		_this.proxyController.ProxyGetRequest(c)
 	case http.MethodPost:
 		_this.proxyController.ProxyPostRequest(c)
 	case http.MethodPut:
@@ -102,6 +138,14 @@ func (_this serverImpl) router(c *gin.Context) {
 		_this.proxyController.ProxyDeleteRequest(c)
 	case http.MethodOptions:
 		_this.proxyController.ProxyOptionsRequest(c)
+	case http.MethodPatch:
+		_this.proxyController.ProxyPatchRequest(c)
+	case http.MethodHead:
+		_this.proxyController.ProxyHeadRequest(c)
+	case http.MethodTrace:
+		_this.proxyController.ProxyTraceRequest(c)
+	case http.MethodConnect:
+		_this.proxyController.ProxyConnectRequest(c)
 	default:
 		c.Status(http.StatusMethodNotAllowed)
 	}
@@ -111,8 +155,11 @@ func (_this serverImpl) Run() {
 	// Start the proxy server
 	_this.runProxyServer()
 
-	// Start the metrics server
-	_this.runMetricsServer()
+	// Start the admin server
+	_this.runAdminServer()
+
+	// Reload the config on SIGHUP
+	_this.handleReloadSignal()
 
 	// Graceful shutdown
 	_this.gracefulShutdown()
@@ -126,8 +173,8 @@ func (_this serverImpl) runProxyServer() {
 	go func() {
 		defer _this.wg.Done()
 
-		_this.logger.Infof("server: proxy server starting on %s", _this.proxyServer.Addr)
-		err := _this.proxyServer.ListenAndServe()
+		_this.logger.Infof("server: proxy server starting on %s, tls: %t", _this.proxyServer.Addr, _this.cfg.Proxy.TLS.Enabled())
+		err := _this.listenAndServe(_this.proxyServer, "proxy", _this.cfg.Proxy.TLS)
 
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			_this.logger.Fatalf("proxy server listen error: %s", err)
@@ -135,16 +182,16 @@ func (_this serverImpl) runProxyServer() {
 	}()
 }
 
-func (_this serverImpl) runMetricsServer() {
+func (_this serverImpl) runAdminServer() {
 	_this.wg.Add(1)
 	go func() {
 		defer _this.wg.Done()
 
-		_this.logger.Infof("server: metrics server starting on %s", _this.metricsServer.Addr)
-		err := _this.metricsServer.ListenAndServe()
+		_this.logger.Infof("server: admin server starting on %s, tls: %t", _this.adminServer.Addr, _this.cfg.Metrics.TLS.Enabled())
+		err := _this.listenAndServe(_this.adminServer, "admin", _this.cfg.Metrics.TLS)
 
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			_this.logger.Fatalf("metrics server listen error: %s", err)
+			_this.logger.Fatalf("admin server listen error: %s", err)
 		}
 	}()
 }
@@ -156,9 +203,14 @@ func (_this serverImpl) gracefulShutdown() {
 
 		// Wait for interrupt signal to gracefully shutdown the server
 		quit := make(chan os.Signal, 1)
-		signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP)
+		signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 		<-quit
 
+		// Fail readiness first and keep serving while load balancers take us out of rotation
+		_this.healthController.SetDraining()
+		_this.logger.Infof("server: draining for %s...", _this.cfg.Health.ShutdownDelay)
+		time.Sleep(_this.cfg.Health.ShutdownDelay)
+
 		_this.serverCtxCancel()
 		_this.logger.Infof("server: shutdown started...")
 
@@ -166,6 +218,9 @@ func (_this serverImpl) gracefulShutdown() {
 			_this.logger.Fatalf("server: shutdown error(s): %v", errs)
 		}
 
+		// Nothing is proxied anymore, flush what the controller still holds
+		_this.proxyController.Close()
+
 		_this.logger.Infof("server: shutdown complete")
 		_ = _this.logger.Sync()
 	}()
@@ -176,8 +231,8 @@ func (_this serverImpl) shutdownServers() (errs []error) {
 	if err := _this.proxyServer.Shutdown(_this.ctx); err != nil {
 		errs = append(errs, fmt.Errorf("proxy server shutdown error: %w", err))
 	}
-	if err := _this.metricsServer.Shutdown(_this.ctx); err != nil {
-		errs = append(errs, fmt.Errorf("metrics server shutdown error: %w", err))
+	if err := _this.adminServer.Shutdown(_this.ctx); err != nil {
+		errs = append(errs, fmt.Errorf("admin server shutdown error: %w", err))
 	}
 	return errs
 }
@@ -186,6 +241,11 @@ func (_this serverImpl) panicHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		defer func() {
 			if err := recover(); err != nil {
+				// Aborted handlers are no failures, the server closes the connection without a response
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
 				// Record panic metric
 				attrs := []attribute.KeyValue{
 					attribute.String("method", c.Request.Method),
@@ -197,7 +257,8 @@ func (_this serverImpl) panicHandler() gin.HandlerFunc {
 					_this.ctx,
 					metric.MetricPanics,
 					c.Request.Method,
-					c.Request.URL.Path,
+					// Empty when the panic happened before the request was routed
+					c.GetString(controllers.RouteContextKey),
 					attrs...,
 				); recordErr != nil {
 					_this.logger.Errorw("failed to record panic metric", "error", recordErr)
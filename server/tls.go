@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/3box/go-proxy/common/config"
+	"github.com/3box/go-proxy/common/logging"
+	"github.com/3box/go-proxy/common/metric"
+)
+
+// expiryInterval refreshes the certificate expiry gauge when the certificate files are not watched
+const expiryInterval = time.Hour
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certificateStore serves the certificates of a TLS listener, reloading them when their files change
+type certificateStore struct {
+	ctx      context.Context
+	listener string
+	cfg      config.ListenerTLSConfig
+	logger   logging.Logger
+	metrics  metric.MetricService
+
+	certificates atomic.Pointer[[]*tls.Certificate]
+}
+
+func newCertificateStore(
+	ctx context.Context,
+	listener string,
+	cfg config.ListenerTLSConfig,
+	logger logging.Logger,
+	metrics metric.MetricService,
+) (*certificateStore, error) {
+	store := &certificateStore{
+		ctx:      ctx,
+		listener: listener,
+		cfg:      cfg,
+		logger:   logger,
+		metrics:  metrics,
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// tlsConfig returns the listener's TLS settings, the certificate is picked per connection
+func (_this *certificateStore) tlsConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion:     tlsVersions[_this.cfg.MinVersion],
+		GetCertificate: _this.getCertificate,
+	}
+	for _, suite := range tls.CipherSuites() {
+		if slices.Contains(_this.cfg.CipherSuites, suite.Name) {
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, suite.ID)
+		}
+	}
+	return tlsConfig
+}
+
+// load reads every certificate, the current ones are kept unless all of them load
+func (_this *certificateStore) load() error {
+	certificates := make([]*tls.Certificate, 0, len(_this.cfg.Certificates))
+	for _, certCfg := range _this.cfg.Certificates {
+		cert, err := tls.LoadX509KeyPair(certCfg.CertFile, certCfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %s: %w", certCfg.CertFile, err)
+		}
+		certificates = append(certificates, &cert)
+	}
+	_this.certificates.Store(&certificates)
+	_this.recordExpiry()
+	return nil
+}
+
+// getCertificate picks the first certificate valid for the server name the client asked for, the first one when
+// none is
+func (_this *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificates := *_this.certificates.Load()
+	for _, cert := range certificates {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return certificates[0], nil
+}
+
+// watch polls the certificate files and reloads them once they changed. A failed reload is retried on the next
+// poll, since a certificate and its key are rarely replaced at the same instant.
+func (_this *certificateStore) watch() {
+	interval := _this.cfg.ReloadInterval
+	if interval <= 0 {
+		interval = expiryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	modified := _this.modified()
+	for {
+		select {
+		case <-_this.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := _this.modified()
+		if _this.cfg.ReloadInterval <= 0 || slices.Equal(current, modified) {
+			_this.recordExpiry()
+			continue
+		}
+		if err := _this.load(); err != nil {
+			_this.logger.Errorw("failed to reload TLS certificates, keeping the current ones",
+				"listener", _this.listener,
+				"error", err,
+			)
+			continue
+		}
+		modified = current
+		_this.logger.Infow("TLS certificates reloaded", "listener", _this.listener)
+	}
+}
+
+// modified returns the modification times of the certificate files, zero for files that can't be read
+func (_this *certificateStore) modified() []time.Time {
+	var times []time.Time
+	for _, certCfg := range _this.cfg.Certificates {
+		for _, path := range []string{certCfg.CertFile, certCfg.KeyFile} {
+			var modTime time.Time
+			if info, err := os.Stat(path); err == nil {
+				modTime = info.ModTime()
+			}
+			times = append(times, modTime)
+		}
+	}
+	return times
+}
+
+func (_this *certificateStore) recordExpiry() {
+	certificates := *_this.certificates.Load()
+	for i, cert := range certificates {
+		if cert.Leaf == nil {
+			continue
+		}
+		_ = _this.metrics.RecordGauge(
+			_this.ctx,
+			metric.MetricTLSCertificateExpiry,
+			time.Until(cert.Leaf.NotAfter).Hours()/24,
+			attribute.String("listener", _this.listener),
+			attribute.String("certificate", _this.cfg.Certificates[i].CertFile),
+		)
+	}
+}
+
+// listenAndServe serves TLS when the listener has certificates, plain HTTP otherwise
+func (_this serverImpl) listenAndServe(server *http.Server, listener string, cfg config.ListenerTLSConfig) error {
+	if !cfg.Enabled() {
+		return server.ListenAndServe()
+	}
+	store, err := newCertificateStore(_this.serverCtx, listener, cfg, _this.logger, _this.metricService)
+	if err != nil {
+		return err
+	}
+	server.TLSConfig = store.tlsConfig()
+
+	_this.wg.Add(1)
+	go func() {
+		defer _this.wg.Done()
+		store.watch()
+	}()
+	return server.ListenAndServeTLS("", "")
+}